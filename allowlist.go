@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ALLOWLIST_FILE_NAME is used from the config directory if --allowlist isn't
+// given.
+const ALLOWLIST_FILE_NAME = "allowlist.toml"
+
+// AllowEntry acknowledges the differences at paths matching Path (or under
+// them), optionally only of some Kinds, until it Expires.
+type AllowEntry struct {
+	Path    string    `toml:"path"`
+	Kinds   []string  `toml:"kinds"`
+	Reason  string    `toml:"reason"`
+	Expires time.Time `toml:"expires"`
+
+	re *regexp.Regexp
+}
+
+func (e *AllowEntry) String() string {
+	res := e.Path
+	if len(e.Kinds) > 0 {
+		res += " (" + strings.Join(e.Kinds, ", ") + ")"
+	}
+	return res
+}
+
+func (e *AllowEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+func (e *AllowEntry) matches(relPath string, kind string) bool {
+	if len(e.Kinds) > 0 {
+		found := false
+		for _, k := range e.Kinds {
+			found = found || k == kind
+		}
+		if !found {
+			return false
+		}
+	}
+	for p := relPath; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if e.re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowlist is a list of expected differences, which are reported as
+// acknowledged instead of counting as differences. For example:
+//
+//	[[allow]]
+//	path = "Library/Application Support/Foo/state.db"
+//	kinds = ["content", "size"]
+//	reason = "rewritten every time Foo starts"
+//	expires = 2027-01-01
+//
+// Paths are globs like those of .backupchkignore.
+type Allowlist struct {
+	Entries []*AllowEntry `toml:"allow"`
+
+	source string
+	now    time.Time
+}
+
+func LoadAllowlist(filePath string, now time.Time) (*Allowlist, error) {
+	res := &Allowlist{source: filePath, now: now}
+	_, err := toml.DecodeFile(filePath, res)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, entry := range res.Entries {
+		where := fmt.Sprintf("%s: entry %d", filePath, idx+1)
+		if entry.Path == "" {
+			return nil, errors.New(where + ": path is required")
+		}
+		if entry.Reason == "" {
+			return nil, errors.New(where + ": reason is required")
+		}
+		for _, kind := range entry.Kinds {
+			if !diffKinds[kind] {
+				return nil, fmt.Errorf("%s: unknown kind of difference: %s", where, kind)
+			}
+		}
+		entry.re, err = compileIgnorePattern(strings.TrimSuffix(entry.Path, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid path: %s", where, err)
+		}
+	}
+	return res, nil
+}
+
+// Expired returns the entries which have expired, and no longer acknowledge
+// anything.
+func (a *Allowlist) Expired() []*AllowEntry {
+	if a == nil {
+		return nil
+	}
+	res := []*AllowEntry{}
+	for _, entry := range a.Entries {
+		if entry.expired(a.now) {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// Match returns the first entry which acknowledges a difference of kind at
+// relPath, or nil.
+func (a *Allowlist) Match(relPath string, kind string) *AllowEntry {
+	if a == nil {
+		return nil
+	}
+	for _, entry := range a.Entries {
+		if !entry.expired(a.now) && entry.matches(relPath, kind) {
+			return entry
+		}
+	}
+	return nil
+}
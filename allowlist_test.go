@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAllowlist = `
+[[allow]]
+path = "Library/Application Support/Foo/state.db"
+kinds = ["content", "size"]
+reason = "rewritten every time Foo starts"
+
+[[allow]]
+path = "Caches/"
+reason = "caches change all the time"
+
+[[allow]]
+path = "**/*.lock"
+reason = "lock files"
+expires = 2026-10-01
+
+[[allow]]
+path = "tmp"
+reason = "until the cleanup is done"
+expires = 2026-12-01T12:00:00Z
+`
+
+func loadTestAllowlist(t *testing.T, text string, now time.Time) (*Allowlist, error) {
+	filePath := path.Join(t.TempDir(), ALLOWLIST_FILE_NAME)
+	writeTestFile(t, filePath, text)
+	return LoadAllowlist(filePath, now)
+}
+
+func TestAllowlistMatch(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	a, err := loadTestAllowlist(t, testAllowlist, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		relPath string
+		kind    string
+		reason  string
+	}{
+		{"Library/Application Support/Foo/state.db", DIFF_CONTENT, "rewritten every time Foo starts"},
+		{"Library/Application Support/Foo/state.db", DIFF_SIZE, "rewritten every time Foo starts"},
+		// Only the listed kinds
+		{"Library/Application Support/Foo/state.db", DIFF_MISSING, ""},
+		{"Library/Application Support/Foo/state.db-journal", DIFF_CONTENT, ""},
+		// Paths inside a matching directory match too
+		{"Caches", DIFF_MODE, "caches change all the time"},
+		{"Caches/a/b", DIFF_MISSING, "caches change all the time"},
+		{"x/Caches/a", DIFF_MISSING, "caches change all the time"},
+		{"CachesX/a", DIFF_MISSING, ""},
+		// Expired
+		{"a/b.lock", DIFF_CONTENT, ""},
+		{"tmp/x", DIFF_SIZE, "until the cleanup is done"},
+	}
+	for _, test := range tests {
+		reason := ""
+		if entry := a.Match(test.relPath, test.kind); entry != nil {
+			reason = entry.Reason
+		}
+		if reason != test.reason {
+			t.Errorf("%s (%s): got %q, expected %q", test.relPath, test.kind, reason, test.reason)
+		}
+	}
+
+	expired := a.Expired()
+	if len(expired) != 1 || expired[0].Path != "**/*.lock" {
+		t.Errorf("got %v expired, expected **/*.lock", expired)
+	}
+
+	// A nil allowlist acknowledges nothing
+	var none *Allowlist
+	if none.Match("Caches", DIFF_MODE) != nil || none.Expired() != nil {
+		t.Errorf("expected a nil allowlist to match nothing")
+	}
+}
+
+func TestAllowlistExpires(t *testing.T) {
+	// Local dates expire at the start of the day, in local time
+	startOfDay := time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		now     time.Time
+		expired int
+	}{
+		{startOfDay.Add(-time.Second), 0},
+		{startOfDay, 1},
+		{time.Date(2026, 12, 1, 12, 0, 0, 0, time.UTC), 2},
+	} {
+		a, err := loadTestAllowlist(t, testAllowlist, test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := len(a.Expired()); res != test.expired {
+			t.Errorf("at %s: got %d expired, expected %d", test.now, res, test.expired)
+		}
+	}
+}
+
+func TestAllowlistErrors(t *testing.T) {
+	tests := []struct {
+		text  string
+		error string
+	}{
+		{`[[allow]]
+reason = "no path"`, "entry 1: path is required"},
+		{`[[allow]]
+path = "a"
+reason = "ok"
+
+[[allow]]
+path = "b"`, "entry 2: reason is required"},
+		{`[[allow]]
+path = "a"
+kinds = ["size", "colour"]
+reason = "x"`, "entry 1: unknown kind of difference: colour"},
+		{`[[allow]]
+path = "a"
+reason = "x"
+expires = "soon"`, `parsing time "soon"`},
+		{`[[allow]`, "toml"},
+	}
+	for _, test := range tests {
+		_, err := loadTestAllowlist(t, test.text, time.Now())
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("%q: got %v, expected an error containing %q", test.text, err, test.error)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/xml"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +12,7 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,23 +20,34 @@ import (
 
 	"github.com/alexcesaro/log"
 	"github.com/alexcesaro/log/golog"
-	flags "github.com/jessevdk/go-flags"
 )
 
 var ERR_NOT_DIR = errors.New("not a directory")
 
+var ERR_CHANGED_SINCE_BACKUP = errors.New("changed since backup")
+
+const EXIT_DIFFERENCES = 2
+const EXIT_INCOMPLETE = 3
+
 var logger *golog.Logger
 
 var TOTAL_BYTES_READ uint64 = 0
 
 type WalkerItem struct {
-	root        *string
-	path        string
-	err         error
-	stat        *os.FileInfo
-	file        *os.File
-	_relpath    *string
-	SkipReaddir bool
+	root     *string
+	path     string
+	err      error
+	stat     *os.FileInfo
+	file     *os.File
+	_relpath *string
+
+	// The exclude rules which apply to this item (ie, its parent's rules)
+	ignore *ignoreScope
+
+	// Loaded from a saved stack, so it may have been deleted since
+	resumed bool
+	// Given with --include or --files-from, so it may not exist
+	seed bool
 }
 
 func WalkerItemFromFile(root *string, path string, stat *os.FileInfo) *WalkerItem {
@@ -113,7 +125,7 @@ func (i *WalkerItem) Readlink() (string, error) {
 
 func (i *WalkerItem) Open() (*os.File, error) {
 	if i.file == nil {
-		file, err := os.Open(i.path)
+		file, err := throttle.Open(i.path)
 		if err != nil {
 			return nil, err
 		}
@@ -136,6 +148,7 @@ func (i *WalkerItem) Readdir(n int) ([]*WalkerItem, error) {
 	if i.file == nil {
 		return nil, errors.New("Must Open before Readdir")
 	}
+	throttle.Ops.Wait(1)
 	files, err := i.file.Readdir(n)
 	if err != nil {
 		return nil, err
@@ -154,15 +167,93 @@ type DFWalker struct {
 	logfilePos   int
 
 	root    *WalkerItem
+	seeds   []string
 	stack   []*WalkerItem
-	exclude pathMatchFn
+	exclude *Excluder
+
+	// Saved items of walks with other seeds, which are kept so they can be
+	// resumed by a later run with the same seeds
+	deferred []*walkGroup
+
+	marked  []string
+	skipped []SkippedPath
 
 	closeLock sync.Mutex
 }
 
-type pathMatchFn *func(string) bool
+// SkippedPath is a path which wasn't walked, and why.
+type SkippedPath struct {
+	RelPath string
+	Reason  string
+}
+
+// SKIP_NOT_FOUND is the reason --include and --files-from paths which don't
+// exist are skipped.
+const SKIP_NOT_FOUND = "not found in the reference directory"
+
+// walkGroup is the saved stack of a walk of seeds (or of the whole root, if
+// there aren't any).
+type walkGroup struct {
+	seeds []string
+	items []*WalkerItem
+}
+
+// WALK_STACK_SEEDS starts a line of the walk stack with the seeds of the
+// items after it, as JSON. Stacks saved without it belong to a walk of the
+// whole root. Paths can't contain NUL, so it can't be mistaken for one.
+const WALK_STACK_SEEDS = "\x00seeds "
+
+func sameSeeds(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// ItemSource is implemented by DFWalker and CoverageQueue, and yields the
+// reference items to check.
+type ItemSource interface {
+	Next() (*WalkerItem, error)
+	Pending() int
+	Marked() []string
+	Skipped() []SkippedPath
+	Close()
+}
+
+// NewDFWalker creates a walker which saves its state to configDir so an
+// interrupted walk can be resumed. If configDir is "" the state isn't saved.
+// If seeds (paths relative to root) are given, only they are walked instead
+// of the whole root.
+func NewDFWalker(configDir string, root *WalkerItem, exclude *Excluder, seeds []string) (*DFWalker, error) {
+	seedItems := []*WalkerItem{root}
+	if len(seeds) > 0 {
+		seedItems = make([]*WalkerItem, len(seeds))
+		for idx, seed := range seeds {
+			// Reversed so the seeds are walked in the order they're given
+			item := WalkerItemFromFile(root.root, path.Join(root.path, seed), nil)
+			item.seed = true
+			seedItems[len(seeds)-idx-1] = item
+		}
+	}
+
+	if configDir == "" {
+		return &DFWalker{
+			root:    root,
+			seeds:   seeds,
+			stack:   seedItems,
+			exclude: exclude,
+		}, nil
+	}
 
-func NewDFWalker(configDir string, root *WalkerItem, exclude pathMatchFn) (*DFWalker, error) {
 	logfile, err := os.OpenFile(
 		path.Join(configDir, "walk-stack"),
 		os.O_APPEND|os.O_RDWR|os.O_CREATE, 0600)
@@ -175,7 +266,8 @@ func NewDFWalker(configDir string, root *WalkerItem, exclude pathMatchFn) (*DFWa
 		return nil, err
 	}
 
-	stack := []*WalkerItem{root}
+	stack := seedItems
+	deferred := []*walkGroup{}
 
 	if offset > 0 {
 		logger.Info("Loading previous run state from cache...")
@@ -184,8 +276,18 @@ func NewDFWalker(configDir string, root *WalkerItem, exclude pathMatchFn) (*DFWa
 			return nil, err
 		}
 
+		groups := []*walkGroup{{}}
 		scanner := bufio.NewScanner(logfile)
 		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), WALK_STACK_SEEDS) {
+				group := &walkGroup{}
+				err := json.Unmarshal([]byte(scanner.Text()[len(WALK_STACK_SEEDS):]), &group.seeds)
+				if err != nil {
+					return nil, fmt.Errorf("invalid walk stack %s: %s", logfile.Name(), err)
+				}
+				groups = append(groups, group)
+				continue
+			}
 			line := strings.Trim(scanner.Text(), " \n")
 			if len(line) == 0 {
 				continue
@@ -194,19 +296,99 @@ func NewDFWalker(configDir string, root *WalkerItem, exclude pathMatchFn) (*DFWa
 				&root.path,
 				path.Join(root.path, scanner.Text()),
 				nil)
-			item.SkipReaddir = true
-			stack = append(stack, item)
+			item.resumed = true
+			group := groups[len(groups)-1]
+			group.items = append(group.items, item)
+		}
+		err = scanner.Err()
+		if err != nil {
+			return nil, err
+		}
+
+		// The saved stack of a walk with the same seeds holds only items
+		// which haven't been visited yet, so it replaces the seeds instead
+		// of being added on top of them. Other walks are left for later.
+		for _, group := range groups {
+			if len(group.items) == 0 {
+				continue
+			}
+			if sameSeeds(group.seeds, seeds) {
+				stack = group.items
+			} else {
+				deferred = append(deferred, group)
+			}
 		}
 	}
 
 	return &DFWalker{
-		logfile: logfile,
-		root:    root,
-		stack:   stack,
-		exclude: exclude,
+		logfile:  logfile,
+		root:     root,
+		seeds:    seeds,
+		stack:    stack,
+		exclude:  exclude,
+		deferred: deferred,
 	}, nil
 }
 
+func underAnyPath(relPath string, parents []string) bool {
+	for _, parent := range parents {
+		if parent == "" || relPath == parent || strings.HasPrefix(relPath, parent+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// seedPaths converts --include and --files-from paths to paths relative to
+// refRoot. Absolute paths must be inside refRoot.
+func seedPaths(refRoot string, paths []string) ([]string, error) {
+	absRoot, err := filepath.Abs(refRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(paths))
+	for _, p := range paths {
+		rel := filepath.Clean(p)
+		if filepath.IsAbs(p) {
+			rel, err = filepath.Rel(absRoot, rel)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, errors.New(p + " is not inside " + refRoot)
+		}
+		if rel == "." {
+			rel = ""
+		}
+		res = append(res, filepath.ToSlash(rel))
+	}
+	return res, nil
+}
+
+func readFilesFrom(name string) ([]string, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		f, err = os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+
+	res := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 {
+			res = append(res, line)
+		}
+	}
+	return res, scanner.Err()
+}
+
 func (w *DFWalker) flush() {
 	logfile := w.logfile
 	if logfile == nil {
@@ -225,13 +407,24 @@ func (w *DFWalker) flush() {
 		return
 	}
 
-	if len(w.stack) == 0 {
+	if len(w.stack) == 0 && len(w.deferred) == 0 {
 		return
 	}
 
 	logger.Info("Flushing walker stack to", logfile.Name())
-	for _, item := range w.stack {
-		logfile.Write([]byte(item.RelPath() + "\n"))
+	groups := append(w.deferred, &walkGroup{seeds: w.seeds, items: w.stack})
+	for _, group := range groups {
+		if len(group.items) == 0 {
+			continue
+		}
+		seeds, _ := json.Marshal(group.seeds)
+		if group.seeds == nil {
+			seeds = []byte("[]")
+		}
+		logfile.Write([]byte(WALK_STACK_SEEDS + string(seeds) + "\n"))
+		for _, item := range group.items {
+			logfile.Write([]byte(item.RelPath() + "\n"))
+		}
 	}
 }
 
@@ -247,6 +440,10 @@ func (w *DFWalker) Close() {
 	}
 }
 
+func (w *DFWalker) Pending() int {
+	return len(w.stack)
+}
+
 func (w *DFWalker) stackPop() *WalkerItem {
 	if len(w.stack) == 0 {
 		return nil
@@ -256,69 +453,156 @@ func (w *DFWalker) stackPop() *WalkerItem {
 	return item
 }
 
+// Marked returns the directories which were skipped because they contain a
+// marker file.
+func (w *DFWalker) Marked() []string {
+	return w.marked
+}
+
+// Skipped returns the paths which were excluded since it was last called.
+func (w *DFWalker) Skipped() []SkippedPath {
+	res := w.skipped
+	w.skipped = nil
+	return res
+}
+
 func (w *DFWalker) Next() (*WalkerItem, error) {
+	for {
+		item, marker, err := w.next()
+		if err != nil || item == nil || marker == "" {
+			return item, err
+		}
+		logger.Debugf("%s: skipping directory marked with %s", item.RelPath(), marker)
+		w.marked = append(w.marked, item.RelPath())
+	}
+}
+
+func (w *DFWalker) next() (*WalkerItem, string, error) {
 	item := w.stackPop()
+	for item != nil && (item.resumed || item.seed) && os.IsNotExist(item.Err()) {
+		if item.seed {
+			logger.Warningf("%s: %s; skipping", item.RelPath(), SKIP_NOT_FOUND)
+			w.skipped = append(w.skipped, SkippedPath{item.RelPath(), SKIP_NOT_FOUND})
+		} else {
+			logger.Infof("%s: deleted since the walk was saved; skipping", item.RelPath())
+		}
+		item = w.stackPop()
+	}
 	if item == nil {
-		return nil, nil
+		return nil, "", nil
 	}
 
 	if item.Err() != nil {
-		return nil, item.Err()
+		return nil, "", item.Err()
 	}
 
-	if item.IsDir() && !item.SkipReaddir {
+	if item.IsDir() {
 		_, err := item.Open()
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		defer item.Close()
 
+		children := []*WalkerItem{}
+		markers := []*WalkerItem{}
+		hasIgnoreFile := false
 		for {
 			contents, err := item.Readdir(1000)
 			if err != nil && err != io.EOF {
-				return nil, err
+				return nil, "", err
 			}
 			for _, p := range contents {
-				if w.exclude != nil && (*w.exclude)(p.RelPath()) {
-					continue
+				name := (*p.stat).Name()
+				if name == IGNORE_FILE_NAME {
+					hasIgnoreFile = true
+				}
+				if w.exclude.isMarker(name) {
+					markers = append(markers, p)
 				}
-				w.stack = append(w.stack, p)
 			}
+			children = append(children, contents...)
 
 			if len(contents) == 0 {
 				break
 			}
 		}
+
+		if marker := w.exclude.markedBy(markers); marker != "" {
+			return item, marker, nil
+		}
+
+		// Items loaded from a saved stack don't know which ignore files
+		// apply to them, so they're found again.
+		var scope *ignoreScope
+		if item.ignore == nil {
+			scope = w.exclude.scopeFor(w.root, item.RelPath())
+		} else {
+			scope = w.exclude.childScope(item.ignore, item, hasIgnoreFile)
+		}
+
+		for _, p := range children {
+			p.ignore = scope
+			if rule := w.exclude.Match(scope, p.RelPath(), p.IsDir()); rule != "" {
+				logger.Debugf("%s: excluded by %s", p.RelPath(), rule)
+				w.skipped = append(w.skipped, SkippedPath{p.RelPath(), "excluded by " + rule})
+				continue
+			}
+			w.stack = append(w.stack, p)
+		}
 	}
 
-	return item, nil
+	return item, "", nil
 }
 
-func checkError(reference interface{}, backup interface{}, msg string) error {
-	return errors.New(fmt.Sprintf("%s: reference %v != backup %v",
-		msg, reference, backup))
+// changedAt returns the last time a file's contents or metadata changed. The
+// change time is included so files which were moved or copied into place
+// with an old modification time still count as changed.
+func changedAt(fi os.FileInfo) time.Time {
+	ctime := fileCtime(fi)
+	if ctime.After(fi.ModTime()) {
+		return ctime
+	}
+	return fi.ModTime()
 }
 
-func check(refItem *WalkerItem, bckItem *WalkerItem) error {
-	bckPtr, err := bckItem.Stat()
+// check compares a reference item with its backup. If cutoff isn't zero, it's
+// the time the backup was taken, and items changed or created after it are
+// reported as ERR_CHANGED_SINCE_BACKUP instead of as errors.
+func check(refItem *WalkerItem, bckItem *WalkerItem, cutoff time.Time) error {
+	refPtr, err := refItem.Stat()
 	if err != nil {
 		return err
 	}
+	ref := *refPtr
 
-	refPtr, err := refItem.Stat()
+	changedSinceBackup := !cutoff.IsZero() && changedAt(ref).After(cutoff)
+
+	bckPtr, err := bckItem.Stat()
 	if err != nil {
-		return err
+		if changedSinceBackup {
+			return ERR_CHANGED_SINCE_BACKUP
+		}
+		return missingError(err)
 	}
-
 	bck := *bckPtr
-	ref := *refPtr
+
+	if changedSinceBackup {
+		return ERR_CHANGED_SINCE_BACKUP
+	}
 
 	if ref.ModTime().After(bck.ModTime()) {
-		return nil
+		if cutoff.IsZero() || ref.IsDir() {
+			return ERR_CHANGED_SINCE_BACKUP
+		}
+		return checkError(
+			DIFF_STALE,
+			ref.ModTime().Format(time.RFC3339),
+			bck.ModTime().Format(time.RFC3339),
+			"stale backup (modified before the backup was taken, but the backup is older)")
 	}
 
 	if ref.IsDir() != bck.IsDir() {
-		return checkError(ref.IsDir(), bck.IsDir(), "IsDir does not match")
+		return checkError(DIFF_TYPE, ref.IsDir(), bck.IsDir(), "IsDir does not match")
 	}
 
 	if bck.IsDir() {
@@ -326,13 +610,13 @@ func check(refItem *WalkerItem, bckItem *WalkerItem) error {
 	}
 
 	if ref.Mode() != bck.Mode() {
-		return checkError(ref.Mode(), bck.Mode(), "mode mismatch")
+		return checkError(DIFF_MODE, ref.Mode(), bck.Mode(), "mode mismatch")
 	}
 
 	rIsSymlink := ref.Mode()&os.ModeType == os.ModeSymlink
 	bIsSymlink := bck.Mode()&os.ModeType == os.ModeSymlink
 	if rIsSymlink != bIsSymlink {
-		return checkError(rIsSymlink, bIsSymlink, "IsSymlink mismatch")
+		return checkError(DIFF_TYPE, rIsSymlink, bIsSymlink, "IsSymlink mismatch")
 	}
 
 	if rIsSymlink {
@@ -347,14 +631,14 @@ func check(refItem *WalkerItem, bckItem *WalkerItem) error {
 		}
 
 		if rLink != bLink {
-			return checkError(rLink, bLink, "symlink target mismatch")
+			return checkError(DIFF_SYMLINK, rLink, bLink, "symlink target mismatch")
 		}
 
 		return nil
 	}
 
 	if ref.Size() != bck.Size() {
-		return checkError(FormatInt(ref.Size()), FormatInt(bck.Size()), "size do not match")
+		return checkError(DIFF_SIZE, FormatInt(ref.Size()), FormatInt(bck.Size()), "size do not match")
 	}
 
 	rf, err := refItem.Open()
@@ -375,12 +659,12 @@ func check(refItem *WalkerItem, bckItem *WalkerItem) error {
 	chunkNum := 0
 	for {
 		chunkNum += 1
-		rSz, err := rf.Read(rChunk)
+		rSz, err := throttle.Read(rf, rChunk)
 		if err != nil && err != io.EOF {
 			return err
 		}
 
-		bSz, err := bf.Read(bChunk)
+		bSz, err := throttle.Read(bf, bChunk)
 		if err != nil && err != io.EOF {
 			return err
 		}
@@ -388,10 +672,14 @@ func check(refItem *WalkerItem, bckItem *WalkerItem) error {
 		TOTAL_BYTES_READ += uint64(rSz)
 
 		if bytes.Compare(rChunk, bChunk) != 0 {
-			return checkError(
+			offset := (chunkNum - 1) * chunkSize
+			diff := checkError(
+				DIFF_CONTENT,
 				fmt.Sprintf("(chunk of size %d)", rSz),
 				fmt.Sprintf("(chunk of size %d)", bSz),
-				fmt.Sprintf("chunk mismatch at offset %d", (chunkNum-1)*chunkSize))
+				fmt.Sprintf("chunk mismatch at offset %d", offset))
+			diff.Offset = int64(offset)
+			return diff
 		}
 
 		if err == io.EOF {
@@ -403,11 +691,81 @@ func check(refItem *WalkerItem, bckItem *WalkerItem) error {
 	return nil
 }
 
+// PathOptions choose the pairs' files: which are walked or skipped, and
+// when the backup was taken.
+type PathOptions struct {
+	TimeMachine     bool     `short:"t" long:"time-machine" description:"Use Time Machine defaults"`
+	Exclude         []string `short:"x" long:"exclude" description:"Exclude files with relative paths matching this pattern. Matching is simple glob matching (ex, 'foo*bar' matches 'foo/x/bar', 'foobar', and 'foo-bar')"`
+	Include         []string `long:"include" description:"Only check this path (relative to the reference directory, or absolute). Can be given more than once"`
+	FilesFrom       string   `long:"files-from" description:"Only check the paths listed in this file, one per line ('-' for stdin). Directories are checked recursively"`
+	MarkerFile      []string `long:"marker-file" default:"CACHEDIR.TAG" default:".nobackup" description:"Skip directories containing a file with this name, like backup tools do. CACHEDIR.TAG files must have the standard signature"`
+	NoMarkerFiles   bool     `long:"no-marker-files" description:"Don't skip directories containing marker files"`
+	ExcludeFrom     []string `long:"exclude-from" description:"Exclude files matching the gitignore-style rules in this file ('**', '?', '[a-z]', leading '/' to anchor, trailing '/' for directories, and '!' to re-include). Rules in .backupchkignore files found while walking apply to the directory they're in"`
+	TMStdExclusions string   `long:"tm-std-exclusions" description:"Load exclusions from this Time Machine StdExclusions.plist (default with --time-machine: the system StdExclusions.plist)"`
+	TMPreferences   string   `long:"tm-preferences" description:"Load user exclusions from this Time Machine preferences plist (default with --time-machine: /Library/Preferences/com.apple.TimeMachine.plist)"`
+	AsOf            string   `long:"as-of" description:"Time the backup was taken (ex, '2017-02-20 15:37'). Files changed or created after it are ignored. Defaults to the time of the Time Machine backup or snapshot, and is required for ZFS snapshots without a time in their name"`
+}
+
+// FilterOptions only check files with some attributes.
+type FilterOptions struct {
+	MinSize        ByteSize `long:"min-size" description:"Only check files at least this big (ex, '10M')"`
+	MaxSize        ByteSize `long:"max-size" description:"Only check files at most this big (ex, '1G')"`
+	ModifiedWithin Age      `long:"modified-within" description:"Only check files modified within this long (ex, '7d')"`
+	OlderThan      Age      `long:"older-than" description:"Only check files last modified at least this long ago (ex, '1y')"`
+	Type           string   `long:"type" description:"Only check these types, comma separated: f (file), d (directory), l (symlink), p (pipe), s (socket), c and b (devices)"`
+	Ext            []string `long:"ext" description:"Only check files with these extensions, comma separated (ex, 'jpg,raw')"`
+}
+
+type CheckOptions struct {
+	PathOptions
+	FilterOptions
+
+	CoverageDays    int           `long:"coverage-days" description:"Only check files which haven't been verified in this many days, most overdue first (combine with --max-duration or --max-bytes to spread verification over several runs)"`
+	MaxDuration     time.Duration `long:"max-duration" description:"Stop cleanly after this much time (ex, '2h'); the next run resumes where this one stopped"`
+	MaxBytes        ByteSize      `long:"max-bytes" description:"Stop cleanly after reading this many bytes (ex, '500G'); the next run resumes where this one stopped"`
+	BwLimit         ByteSize      `long:"bwlimit" description:"Limit reads from the reference and backup to this many bytes per second (ex, '50M'). Can be changed while running by writing 'bwlimit 20M' to <config-dir>/throttle"`
+	OpsLimit        float64       `long:"ops-limit" description:"Limit opens, reads, and directory listings to this many per second. Can be changed while running by writing 'ops-limit 100' to <config-dir>/throttle"`
+	FailOn          []string      `long:"fail-on" description:"Only exit with status 2 for these kinds of differences, comma separated: missing, type, mode, symlink, size, content, stale-backup, error (default: all of them)"`
+	Output          string        `long:"output" choice:"text" choice:"json" default:"text" description:"Write results to stdout as text, or as JSON lines with one event per line (differences, skips, and summaries)"`
+	Events          string        `long:"events" description:"Also write results as JSON lines to this file ('-' for stdout)"`
+	HTMLReport      string        `long:"html-report" description:"Write a self-contained HTML report to this file, with a summary of each pair and a tree of its differences"`
+	MetricsFile     string        `long:"metrics-file" description:"Write Prometheus metrics to this file after each pair, for node_exporter's textfile collector (ex, '/var/lib/node_exporter/backup-chk.prom')"`
+	Pushgateway     string        `long:"pushgateway" description:"Push Prometheus metrics to this Pushgateway after each pair (ex, 'http://localhost:9091')"`
+	OnSuccess       string        `long:"on-success" value-name:"CMD" description:"Run this shell command after each pair which finishes without failing differences; see README for its BACKUP_CHK_* environment variables"`
+	OnFailure       string        `long:"on-failure" value-name:"CMD" description:"Run this shell command after each pair with failing differences, or which was stopped early"`
+	OnDifference    string        `long:"on-difference" value-name:"CMD" description:"Run this shell command after each pair with any differences"`
+	Webhook         string        `long:"webhook" value-name:"URL" description:"POST to URL/start when a run starts, URL when it succeeds, and URL/fail when it fails (like healthchecks.io pings)"`
+	WebhookTemplate string        `long:"webhook-template" value-name:"FILE" description:"A Go text/template for the webhook's JSON payload, instead of the default"`
+	WebhookCA       string        `long:"webhook-ca" value-name:"FILE" description:"PEM certificates to trust for the webhook, as well as the system's"`
+	WebhookRetries  int           `long:"webhook-retries" default:"5" description:"Retry failed webhooks this many times, waiting 1s, 2s, 4s, ... between them"`
+	EmailTo         []string      `long:"email-to" value-name:"ADDRESS" description:"Email a summary of each run to these addresses, comma separated or repeated"`
+	EmailFrom       string        `long:"email-from" value-name:"ADDRESS" description:"The From address of emails (default: backup-chk@<hostname>)"`
+	EmailPolicy     string        `long:"email-policy" choice:"always" choice:"failure" choice:"weekly" default:"always" description:"Email after every run, only after runs with a non-zero exit status, or a weekly digest of every run"`
+	EmailMaxDiffs   int           `long:"email-max-diffs" default:"20" description:"List at most this many differences of each pair in emails"`
+	SMTPServer      string        `long:"smtp-server" value-name:"HOST:PORT" default:"localhost:25" description:"The SMTP server to send email with"`
+	SMTPUser        string        `long:"smtp-user" description:"Authenticate to the SMTP server as this user"`
+	SMTPPassword    string        `long:"smtp-password" env:"BACKUP_CHK_SMTP_PASSWORD" description:"The SMTP user's password (better set with $BACKUP_CHK_SMTP_PASSWORD)"`
+	SMTPTLS         string        `long:"smtp-tls" choice:"starttls" choice:"none" default:"starttls" description:"Require STARTTLS, or send without encryption (ex, to a local relay)"`
+	Allowlist       string        `long:"allowlist" value-name:"FILE" description:"Acknowledge the expected differences in this TOML file, which are reported separately and don't affect the exit status (default: <config-dir>/allowlist.toml, if it exists)"`
+	OnlyNew         bool          `long:"only-new" description:"Only show and report differences which the last complete run of the pair didn't find (the rest are still counted, and in the session log)"`
+	HistoryDays     int           `long:"history-days" default:"365" description:"Prune runs older than this many days from the history (0 to keep them)"`
+	HistoryRuns     int           `long:"history-runs" default:"1000" description:"Keep only this many of the most recent runs of each pair in the history (0 to keep them all)"`
+	StatusAddr      string        `long:"status-addr" description:"Serve the progress of the run over HTTP on this address, as a page at / and JSON at /status.json (ex, '127.0.0.1:9123')"`
+	JUnit           string        `long:"junit" description:"Write a JUnit XML report to this file, with a testsuite for each pair and a failing testcase for each difference"`
+	IOClass         string        `long:"io-class" choice:"idle" choice:"low" choice:"normal" description:"Linux I/O scheduling class (default: low when --bwlimit or --ops-limit is used)"`
+}
+
 type CmdlineOptions struct {
-	Verbose     []bool   `short:"v" long:"verbose" description:"Show verbose debug information"`
-	TimeMachine bool     `short:"t" long:"time-machine" description:"Use Time Machine defaults"`
-	Exclude     []string `short:"x" long:"exclude" description:"Exclude files with relative paths matching this pattern. Matching is simple glob matching (ex, 'foo*bar' matches 'foo/x/bar', 'foobar', and 'foo-bar')"`
-	ConfigDir   string   `short:"c" long:"config-dir" default:"~/.backup-chk/" description:"Configuration and status directory"`
+	Verbose   []bool `short:"v" long:"verbose" description:"Show verbose debug information"`
+	ConfigDir string `short:"c" long:"config-dir" description:"Configuration and status directory (default: ~/.backup-chk/, or $XDG_CONFIG_HOME/backup-chk/ and $XDG_STATE_HOME/backup-chk/ if they're set and ~/.backup-chk/ doesn't exist)"`
+
+	Check    CheckCommand    `command:"check" description:"Check backups against their reference directories (the default command)"`
+	Coverage CoverageCommand `command:"coverage" description:"Show how much of each reference directory has been verified recently"`
+	Run      RunCommand      `command:"run" description:"Check the pairs in a config.toml profile, using its options"`
+	Explain  ExplainCommand  `command:"explain" description:"Explain whether paths would be checked, and if not, why"`
+	Status   StatusCommand   `command:"status" description:"Show the last run and pending resume state of each reference directory"`
+	Reset    ResetCommand    `command:"reset" description:"Discard the resume state of reference directories, so their next run starts from the beginning"`
+	History  HistoryCommand  `command:"history" description:"Show past runs of each pair, and how their throughput and differences are trending"`
 }
 
 type TMGuess struct {
@@ -418,6 +776,17 @@ type TMGuess struct {
 	Okay           bool
 	Directory      *string
 	HomeVolumeName *string
+	Time           time.Time
+}
+
+// timeMachineBackupTime parses the time from a Time Machine backup directory
+// name, like ".../Backups.backupdb/host/2017-02-20-153725".
+func timeMachineBackupTime(dir string) (time.Time, error) {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err == nil {
+		dir = resolved
+	}
+	return time.ParseInLocation("2006-01-02-150405", filepath.Base(dir), time.Local)
 }
 
 func darwinGetRootDeviceName() (string, error) {
@@ -426,40 +795,18 @@ func darwinGetRootDeviceName() (string, error) {
 		return "", err
 	}
 
-	type Node struct {
-		XMLName xml.Name
-		Content string `xml:",chardata"`
-		Nodes   []Node `xml:",any"`
+	val, err := DecodePlist(outBytes)
+	if err != nil {
+		return "", err
 	}
 
-	r := strings.NewReader(string(outBytes))
-	d := xml.NewDecoder(r)
-
-	n := Node{}
-	d.Decode(&n)
-
-	walk := func(node Node, prev Node) (string, error) { return "", nil }
-	walk = func(node Node, prev Node) (string, error) {
-		if prev.XMLName.Local == "key" && prev.Content == "VolumeName" {
-			if node.XMLName.Local != "string" {
-				return "", errors.New("error parsing plist (got unexpected node after VolumeName: " + node.XMLName.Local + ")")
-			}
-			return string(node.Content), nil
-		}
-		for _, child := range node.Nodes {
-			res, err := walk(child, prev)
-			if err != nil {
-				return "", err
-			}
-			if len(res) > 0 {
-				return res, nil
-			}
-			prev = child
-		}
-		return "", nil
+	dict, ok := val.(map[string]interface{})
+	if !ok {
+		return "", ERR_PLIST_NOT_DICT
 	}
-	res, err := walk(n, n)
-	if len(res) == 0 {
+
+	res, ok := dict["VolumeName"].(string)
+	if !ok || len(res) == 0 {
 		return "", errors.New("Could not find VolumeName in diskutil output")
 	}
 	return res, nil
@@ -500,11 +847,17 @@ func guessTimeMachineBackup() *TMGuess {
 		}
 	}
 
+	backupTime, err := timeMachineBackupTime(out)
+	if err != nil {
+		logger.Infof("could not find the time of backup %s (not ignoring files changed after it): %s", out, err)
+	}
+
 	return &TMGuess{
 		Okay: true,
 
 		Directory:      &out,
 		HomeVolumeName: &homeVolName,
+		Time:           backupTime,
 	}
 }
 
@@ -520,46 +873,69 @@ func showTimeMachineHelp(g *TMGuess, indent string) {
 	}
 }
 
-func buildExcludeFunc(rawPats []string) (pathMatchFn, error) {
-	if len(rawPats) == 0 {
-		return nil, nil
-	}
-
-	pats := make([][]string, len(rawPats))
-	for idx, pat := range rawPats {
-		pat = strings.Trim(pat, "*")
-		pats[idx] = strings.Split(pat, "*")
-	}
-
-	excludeFunc := func(p string) bool {
-		for patIdx, pat := range pats {
-			loc := 0
-			for _, patBit := range pat {
-				loc = strings.Index(p[loc:], patBit)
-				if loc < 0 {
-					break
-				}
-			}
+type Pair struct {
+	ref    *WalkerItem
+	bck    *WalkerItem
+	cutoff time.Time
+	seeds  []string
 
-			if loc >= 0 {
-				if patIdx > 0 {
-					pats[patIdx-1], pats[patIdx] = pats[patIdx], pats[patIdx-1]
-				}
-				return true
-			}
-		}
+	// The backup directory, or the root of its snapshots, so state kept for
+	// the backup carries over to newer snapshots
+	bckKey string
+}
 
-		return false
+// runStatusDirFor returns the directory where the walker state, coverage
+// ledger, and session log for a reference directory are kept.
+func runStatusDirFor(stateDir string, ref *WalkerItem) (string, error) {
+	name, err := runStatusName(*ref.root)
+	if err != nil {
+		return "", err
 	}
-
-	return &excludeFunc, nil
+	return path.Join(stateDir, "run-status", name), nil
 }
 
 func _main() int {
 	opts := CmdlineOptions{}
-	parser := flags.NewParser(&opts, flags.Default)
-	parser.Usage = "[OPTIONS] [-vv] [--time-machine] [REFERENCE_DIR:BACKUP_DIR ...]"
-	args, err := parser.Parse()
+	parser := newCmdlineParser(&opts)
+	cmdArgs, cmdIdx := commandArgs(parser, os.Args[1:])
+	args, err := parser.ParseArgs(cmdArgs)
+
+	// Load the profile's options, then parse the command line again so it
+	// can override them
+	if err == nil && parser.Active != nil && parser.Active.Name == "run" {
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "Usage: run PROFILE [REFERENCE_DIR:BACKUP_DIR ...]")
+			return 1
+		}
+		configDir, _, err := resolveConfigDirs(opts.ConfigDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		config, configPath, err := LoadConfigFile(configDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading %s: %s\n", configPath, err)
+			return 1
+		}
+		profileArgs, profilePairs, err := config.ProfileArgs(args[0], parser.Active)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error in %s: %s\n", configPath, err)
+			return 1
+		}
+
+		runArgs := append([]string{}, cmdArgs[:cmdIdx+1]...)
+		runArgs = append(runArgs, profileArgs...)
+		runArgs = append(runArgs, cmdArgs[cmdIdx+1:]...)
+		opts = CmdlineOptions{}
+		parser = newCmdlineParser(&opts)
+		cmdArgs = append(runArgs, profilePairs...)
+		args, err = parser.ParseArgs(cmdArgs)
+		if err != nil {
+			return 1
+		}
+		args = args[1:]
+	}
+	checkOpts := opts.checkOptions(parser.Active)
 
 	// Setup console
 	c := BackupChkConsoleInstallMonkeypatch()
@@ -579,19 +955,53 @@ func _main() int {
 		}
 	}
 
+	// Show or reset the saved run state, or show the history
+	if err == nil && parser.Active != nil && (parser.Active.Name == "status" || parser.Active.Name == "reset" || parser.Active.Name == "history") {
+		_, stateDir, err := resolveConfigDirs(opts.ConfigDir)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+
+		if parser.Active.Name == "status" {
+			err = showStatus(c.Stdout, stateDir)
+		} else if parser.Active.Name == "history" {
+			err = showHistory(c.Stdout, stateDir, args, opts.History.Limit)
+		} else if len(args) == 0 {
+			err = errors.New("reset needs at least one REFERENCE_DIR (see 'status')")
+		} else {
+			for _, target := range args {
+				err = resetRunStatus(c.Stdout, stateDir, target)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		return 0
+	}
+
 	// Check for TimeMachine
 	tmGuess := (*TMGuess)(nil)
-	if opts.TimeMachine {
+	if checkOpts != nil && checkOpts.TimeMachine {
 		tmGuess = guessTimeMachineBackup()
 		if (*tmGuess).Directory != nil {
-			args = []string{"/Users/:" + path.Join(*tmGuess.Directory, *tmGuess.HomeVolumeName, "Users")}
+			tmPair := "/Users/:" + path.Join(*tmGuess.Directory, *tmGuess.HomeVolumeName, "Users")
+			if parser.Active.Name == "explain" {
+				args = append([]string{tmPair}, args...)
+			} else {
+				args = []string{tmPair}
+			}
 		}
 		if !tmGuess.Okay {
 			showTimeMachineHelp(tmGuess, "Error: ")
 			return 1
 		}
-		opts.Exclude = append(
-			opts.Exclude,
+		checkOpts.Exclude = append(
+			checkOpts.Exclude,
 			".Trash",
 
 			"Library/Logs",
@@ -618,12 +1028,10 @@ func _main() int {
 	}
 
 	// Show help
-	if err != nil || args == nil || len(args) == 0 {
+	if err != nil || checkOpts == nil || len(args) == 0 {
 		if err == nil {
 			parser.WriteHelp(c.Stdout)
 			fmt.Print("\n")
-		} else {
-			fmt.Println(err)
 		}
 
 		fmt.Println("Example:")
@@ -633,6 +1041,12 @@ func _main() int {
 		}
 		fmt.Printf("  $ %s --time-machine\n", argv0)
 		fmt.Printf("  $ %s /Users/wolever:/Volumes/Backup/Users/wolever\n", argv0)
+		fmt.Printf("  $ %s /home:zfs-latest:/tank/home\n", argv0)
+		fmt.Printf("  $ %s /home:rsnapshot:/backups@latest/localhost/home\n", argv0)
+		fmt.Printf("  $ %s --coverage-days 30 --max-duration 2h /Users/wolever:/Volumes/Backup/Users/wolever\n", argv0)
+		fmt.Printf("  $ %s coverage /Users/wolever:/Volumes/Backup/Users/wolever\n", argv0)
+		fmt.Printf("  $ %s explain /Users/wolever:/Volumes/Backup/Users/wolever Library/Caches/foo\n", argv0)
+		fmt.Printf("  $ %s run laptop  # with a [profiles.laptop] section in %s\n", argv0, CONFIG_FILE_NAME)
 		if tmGuess != nil {
 			fmt.Printf("\nTime Machine:\n")
 			showTimeMachineHelp(tmGuess, "  ")
@@ -641,20 +1055,73 @@ func _main() int {
 		return 1
 	}
 
-	// Parse ref:bck pairs
-	type Pair struct {
-		ref *WalkerItem
-		bck *WalkerItem
+	explainPaths := []string{}
+	if parser.Active.Name == "explain" {
+		if len(args) < 2 {
+			logger.Error("explain needs a REFERENCE_DIR:BACKUP_DIR pair and at least one PATH")
+			return 1
+		}
+		explainPaths = args[1:]
+		args = args[:1]
+	}
+
+	asOf := time.Time{}
+	if checkOpts.AsOf != "" {
+		asOf, err = ParseTimestamp(checkOpts.AsOf)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+	}
+
+	includes := checkOpts.Include
+	if checkOpts.FilesFrom != "" {
+		files, err := readFilesFrom(checkOpts.FilesFrom)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		if len(files) == 0 {
+			logger.Errorf("No paths found in --files-from %s", checkOpts.FilesFrom)
+			return 1
+		}
+		includes = append(includes, files...)
 	}
 
+	// Parse ref:bck pairs
 	pairs := make([]Pair, len(args))
 	for idx, backup := range args {
-		pair := strings.Split(backup, ":")
+		pair := strings.SplitN(backup, ":", 2)
 		if len(pair) != 2 {
 			logger.Errorf("invalid REFERENCE_DIR:BACKUP_DIR pair: %s (hint: /Users/:/Volumes/Backup/Users)", backup)
 			return 1
 		}
 
+		cutoff := time.Time{}
+		bckKey := pair[1]
+		snapshot, isSnapshot, err := parseSnapshotSpec(pair[1])
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		if isSnapshot {
+			if snapshot.Time.IsZero() && asOf.IsZero() {
+				logger.Errorf("%s: the time %s snapshot %s was taken is unknown (hint: give it with --as-of)", backup, snapshot.Layout, snapshot.Name)
+				return 1
+			}
+			taken := ""
+			if !snapshot.Time.IsZero() {
+				taken = " taken at " + snapshot.Time.Local().Format("2006-01-02 15:04:05")
+			}
+			logger.Infof("Using %s snapshot %s%s: %s", snapshot.Layout, snapshot.Name, taken, snapshot.Directory)
+			pair[1] = snapshot.Directory
+			bckKey = snapshot.Root
+			cutoff = snapshot.Time
+		} else if strings.Contains(pair[1], ":") {
+			logger.Errorf("invalid REFERENCE_DIR:BACKUP_DIR pair: %s (hint: /Users/:/Volumes/Backup/Users or /home:zfs-latest:/tank/home)", backup)
+			return 1
+		}
+
 		refRoot, err := WalkerItemFromRoot(pair[0])
 		if err != nil {
 			logger.Error(err)
@@ -667,53 +1134,327 @@ func _main() int {
 			return 1
 		}
 
-		pairs[idx] = Pair{refRoot, bckRoot}
+		if tmGuess != nil && !tmGuess.Time.IsZero() {
+			cutoff = tmGuess.Time
+		}
+		if !asOf.IsZero() {
+			cutoff = asOf
+		}
+		if !cutoff.IsZero() {
+			logger.Infof("Ignoring files changed after %s", cutoff.Local().Format("2006-01-02 15:04:05"))
+		}
+
+		seeds, err := seedPaths(pair[0], includes)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+
+		bckKey, err = filepath.Abs(bckKey)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+
+		pairs[idx] = Pair{
+			ref:    refRoot,
+			bck:    bckRoot,
+			cutoff: cutoff,
+			seeds:  seeds,
+			bckKey: bckKey,
+		}
+	}
+
+	// Load Time Machine exclusions
+	tmStdExclusions := checkOpts.TMStdExclusions
+	tmPreferences := checkOpts.TMPreferences
+	if checkOpts.TimeMachine {
+		if tmStdExclusions == "" {
+			tmStdExclusions = TM_STD_EXCLUSIONS
+		}
+		if tmPreferences == "" {
+			tmPreferences = TM_PREFERENCES
+		}
+	}
+	refRoots := make([]string, len(pairs))
+	for idx, pair := range pairs {
+		refRoots[idx] = *pair.ref.root
+	}
+	tmRules := []*IgnoreRules{}
+	loadTMExcludes := func(stdExclusionsPath string, preferencesPath string) {
+		plistPath := stdExclusionsPath + preferencesPath
+		var rules *IgnoreRules
+		tmExcludes, err := loadTimeMachineExclusions(stdExclusionsPath, preferencesPath, refRoots)
+		if err == nil {
+			rules, err = ParseIgnoreRules(strings.NewReader(strings.Join(tmExcludes, "\n")), plistPath, "")
+		}
+		if err != nil {
+			logger.Warningf("Not using Time Machine exclusions from %s: %s", plistPath, err)
+			return
+		}
+		tmRules = append(tmRules, rules)
+		logger.Infof("Loaded %d Time Machine exclusions from %s", len(tmExcludes), plistPath)
+	}
+	if tmStdExclusions != "" {
+		loadTMExcludes(tmStdExclusions, "")
+	}
+	if tmPreferences != "" {
+		loadTMExcludes("", tmPreferences)
+	}
+
+	// Setup exclude rules
+	markerFiles := checkOpts.MarkerFile
+	if checkOpts.NoMarkerFiles {
+		markerFiles = nil
+	}
+	excluder, err := NewExcluder(checkOpts.Exclude, tmRules, checkOpts.ExcludeFrom, markerFiles)
+	if err != nil {
+		logger.Error(err)
+		return 1
+	}
+
+	// Setup attribute filters
+	filter, err := NewAttrFilter(checkOpts.MinSize, checkOpts.MaxSize, checkOpts.ModifiedWithin, checkOpts.OlderThan, checkOpts.Type, checkOpts.Ext)
+	if err != nil {
+		logger.Error(err)
+		return 1
 	}
 
-	// Setup exclude function
-	excludeFunc, err := buildExcludeFunc(opts.Exclude)
+	failOn, err := parseFailOn(checkOpts.FailOn)
 	if err != nil {
 		logger.Error(err)
 		return 1
 	}
 
 	// Initialize config directory
-	configDir, err := ExpandUser(opts.ConfigDir)
+	configDir, stateDir, err := resolveConfigDirs(opts.ConfigDir)
 	if err != nil {
 		logger.Error(err)
 		return 1
 	}
-	os.Mkdir(configDir, 0700)
+	os.MkdirAll(configDir, 0700)
+	os.MkdirAll(stateDir, 0700)
+
+	switch parser.Active.Name {
+	case "coverage":
+		days := checkOpts.CoverageDays
+		if days <= 0 {
+			days = 30
+		}
+		err := showCoverageReport(c.Stdout, pairs, stateDir, excluder, days)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		return 0
+	case "explain":
+		err := explain(c.Stdout, pairs[0], excluder, filter, explainPaths)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		return 0
+	}
+
+	// Load the allowlist of expected differences
+	allowlistPath := checkOpts.Allowlist
+	if allowlistPath == "" {
+		allowlistPath = path.Join(configDir, ALLOWLIST_FILE_NAME)
+		if _, err := os.Stat(allowlistPath); err != nil {
+			allowlistPath = ""
+		}
+	}
+	var allowlist *Allowlist
+	if allowlistPath != "" {
+		allowlist, err = LoadAllowlist(allowlistPath, time.Now())
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		for _, entry := range allowlist.Expired() {
+			logger.Warningf("%s: %s expired on %s, so its differences count again (%s)",
+				allowlistPath, entry, entry.Expires.Format("2006-01-02"), entry.Reason)
+		}
+	}
+
+	// Setup I/O limits
+	throttle.Bytes.SetRate(float64(checkOpts.BwLimit))
+	throttle.Ops.SetRate(checkOpts.OpsLimit)
+	throttle.WatchControlFile(path.Join(configDir, "throttle"))
+	ioClass := checkOpts.IOClass
+	if ioClass == "" && (checkOpts.BwLimit > 0 || checkOpts.OpsLimit > 0) {
+		ioClass = "low"
+	}
+	if ioClass != "" {
+		err := setIOClass(ioClass)
+		if err != nil {
+			logger.Infof("Not setting I/O class to %s: %s", ioClass, err)
+		}
+	}
 
 	// Setup signal handling
-	var walker *DFWalker
+	var walker ItemSource
+	budget := NewRunBudget(checkOpts.MaxDuration, uint64(checkOpts.MaxBytes))
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
+		sig := <-sigChan
+		logger.Warningf("Got %s; stopping after the current file (send again to quit immediately)", sig)
+		budget.Stop(fmt.Sprintf("got %s", sig))
 		<-sigChan
 		if walker != nil {
 			walker.Close()
 		}
 		c.Close()
-		os.Exit(1)
+		os.Exit(EXIT_INCOMPLETE)
 	}()
 
+	// Setup reporters
+	reporters := Reporters{}
+	defer func() {
+		err := reporters.Close()
+		if err != nil {
+			logger.Errorf("Error closing reports: %s", err)
+		}
+	}()
+	eventLogNames := []string{}
+	// The progress line isn't shown when stdout is JSON lines
+	jsonStdout := checkOpts.Output == "json" || checkOpts.Events == "-"
+	if checkOpts.Output == "json" {
+		eventLogNames = append(eventLogNames, "-")
+	}
+	if checkOpts.Events != "" {
+		eventLogNames = append(eventLogNames, checkOpts.Events)
+	}
+	for _, name := range eventLogNames {
+		eventLog, err := OpenEventLog(name, c.Stdout)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		reporters = append(reporters, eventLog)
+	}
+	if checkOpts.JUnit != "" {
+		reporters = append(reporters, NewJUnitReport(checkOpts.JUnit))
+	}
+	if checkOpts.MetricsFile != "" || checkOpts.Pushgateway != "" {
+		metrics, err := NewMetricsReport(checkOpts.MetricsFile, checkOpts.Pushgateway)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		reporters = append(reporters, metrics)
+	}
+	if checkOpts.HTMLReport != "" {
+		excludes := append([]string{}, checkOpts.Exclude...)
+		for _, name := range checkOpts.ExcludeFrom {
+			excludes = append(excludes, "rules from "+name)
+		}
+		for _, name := range markerFiles {
+			excludes = append(excludes, "directories containing "+name)
+		}
+		reporters = append(reporters, NewHTMLReport(checkOpts.HTMLReport, excludes))
+	}
+	if checkOpts.Webhook != "" {
+		webhook, err := NewWebhook(checkOpts.Webhook, checkOpts.WebhookTemplate, checkOpts.WebhookCA, checkOpts.WebhookRetries)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		reporters = append(reporters, webhook)
+	}
+	if len(checkOpts.EmailTo) > 0 {
+		email, err := NewEmailReport(SMTPOptions{
+			Server:   checkOpts.SMTPServer,
+			User:     checkOpts.SMTPUser,
+			Password: checkOpts.SMTPPassword,
+			TLS:      checkOpts.SMTPTLS,
+			From:     checkOpts.EmailFrom,
+			To:       checkOpts.EmailTo,
+		}, checkOpts.EmailPolicy, checkOpts.EmailMaxDiffs, stateDir)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		reporters = append(reporters, email)
+	}
+	reporters = append(reporters, NewHistoryStore(
+		stateDir,
+		time.Duration(checkOpts.HistoryDays)*24*time.Hour,
+		checkOpts.HistoryRuns,
+	))
+	var liveStatus *LiveStatus
+	if checkOpts.StatusAddr != "" {
+		liveStatus, err = NewLiveStatus(checkOpts.StatusAddr, len(pairs))
+		if err != nil {
+			logger.Errorf("Error serving status: %s", err)
+			return 1
+		}
+		reporters = append(reporters, liveStatus)
+	}
+
+	hooks := &Hooks{
+		OnSuccess:    checkOpts.OnSuccess,
+		OnFailure:    checkOpts.OnFailure,
+		OnDifference: checkOpts.OnDifference,
+	}
+	defer hooks.Close()
+
 	// Actually check things!
 	startTime := time.Now()
-	for _, pair := range pairs {
+	exitStatus := 0
+	totals := PairResult{
+		Started: startTime,
+		Result:  "finished",
+		Diffs:   map[string]int{},
+	}
+	reporters.Report(&Event{
+		Event:   EVENT_RUN_START,
+		Time:    startTime,
+		Pairs:   args,
+		Options: redactOptions(cmdArgs),
+	})
+	// Pairs before the one the last run was stopped in were checked by it
+	pairKeys := make([]string, len(pairs))
+	for idx, pair := range pairs {
+		refAbs, _ := filepath.Abs(*pair.ref.root)
+		pairKeys[idx] = refAbs + ":" + pair.bckKey
+	}
+	resumeFrom, err := LoadResumePair(stateDir, pairKeys)
+	if err != nil {
+		logger.Warningf("Error loading the pair to resume from (starting from the first): %s", err)
+	}
+	stopped := false
+	for idx, pair := range pairs {
+		if idx < resumeFrom {
+			logger.Infof("Skipping: '%s' against '%s' (checked before the last run was stopped)", *pair.bck.root, *pair.ref.root)
+			continue
+		}
 		logger.Infof("Checking: '%s' against '%s'", *pair.bck.root, *pair.ref.root)
+		refAbs, _ := filepath.Abs(*pair.ref.root)
+		bckAbs, _ := filepath.Abs(*pair.bck.root)
+		hooks.PairStarted(refAbs, bckAbs)
+		reporters.Report(&Event{
+			Event:     EVENT_PAIR_START,
+			Reference: *pair.ref.root,
+			Backup:    *pair.bck.root,
+		})
 
 		// Setup status directory
-		refNorm, err := filepath.Abs(*pair.ref.root)
+		runStatusDir, err := runStatusDirFor(stateDir, pair.ref)
 		if err != nil {
 			logger.Error(err)
 			return 1
 		}
-		refNorm = filepath.Clean(refNorm)
-		refNorm = strings.Replace(refNorm, "-", "--", -1)
-		refNorm = strings.Replace(refNorm, "/", "-", -1)[1:]
-		runStatusDir := path.Join(configDir, "run-status", refNorm)
 		os.MkdirAll(runStatusDir, 0700)
+		unlock, err := lockRunStatusDir(runStatusDir)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		defer unlock()
+		pairStartTime := time.Now()
+		pairStartBytes := TOTAL_BYTES_READ
 
 		// Setup logging
 		sessionLogFileName := path.Join(runStatusDir, "log.txt")
@@ -747,24 +1488,84 @@ func _main() int {
 			}
 		}
 
+		// Load the differences of the last complete run against this backup,
+		// to tell which are new
+		previousDiffs, currentDiffs, err := LoadDifferenceSets(runStatusDir, pair.bckKey)
+		if err != nil {
+			logger.Warningf("Error loading previous differences (they'll all be new): %s", err)
+			previousDiffs, currentDiffs = nil, NewDifferenceSet()
+		}
+		// Runs which only check part of the tree can't tell which of the
+		// previous differences were resolved, except those they check
+		scoped := len(pair.seeds) > 0 || filter.Active() || checkOpts.CoverageDays > 0
+		scopedResolved := []string{}
+		if scoped {
+			currentDiffs = NewDifferenceSet()
+		}
+		newCount := 0
+		ackCount := 0
+		ackReasons := map[string]int{}
+
 		// Setup walker
-		walker, err = NewDFWalker(runStatusDir, pair.ref, excludeFunc)
-		defer walker.Close()
+		ledger, err := LoadCoverageLedger(runStatusDir, pair.bckKey)
+		if err != nil {
+			logger.Error(err)
+			return 1
+		}
+		saveLedger := func() {
+			err := ledger.Save()
+			if err != nil {
+				logger.Errorf("Error saving coverage ledger: %s", err)
+			}
+		}
+		// So files verified before a fatal error aren't verified again
+		defer saveLedger()
+
+		if checkOpts.CoverageDays > 0 {
+			walker, err = NewCoverageQueue(ledger, pair.ref, excluder, pair.seeds, checkOpts.CoverageDays)
+		} else {
+			walker, err = NewDFWalker(runStatusDir, pair.ref, excluder, pair.seeds)
+		}
 		if err != nil {
 			logger.Error(err)
 			return 1
 		}
+		defer walker.Close()
 
 		count := 0
 		errCount := 0
+		diffCounts := map[string]int{}
+		changedCount := 0
+		filtered := map[string]int{}
+		filteredCount := 0
+		excludedCount := 0
 		lastTime := time.Time{}
+		stopReason := ""
 		for {
+			stopReason = budget.Exhausted()
+			if stopReason != "" {
+				break
+			}
+
 			refItem, err := walker.Next()
 			if err != nil {
 				logger.Error(err)
 				return 1
 			}
 
+			for _, skipped := range walker.Skipped() {
+				if skipped.Reason != SKIP_NOT_FOUND {
+					excludedCount += 1
+				}
+				reporters.Report(&Event{
+					Event:     EVENT_SKIP,
+					Reference: *pair.ref.root,
+					Backup:    *pair.bck.root,
+					Path:      skipped.RelPath,
+					Reason:    skipped.Reason,
+				})
+			}
+
 			if refItem == nil {
 				break
 			}
@@ -775,19 +1576,81 @@ func _main() int {
 				return 1
 			}
 
+			if reason := filter.Skip(refItem); reason != "" {
+				filtered[reason] += 1
+				filteredCount += 1
+				reporters.Report(&Event{
+					Event:     EVENT_SKIP,
+					Reference: *pair.ref.root,
+					Backup:    *pair.bck.root,
+					Path:      refItem.RelPath(),
+					Reason:    "filtered by " + reason,
+				})
+				continue
+			}
+
+			liveStatus.Update(refItem.RelPath(), count, errCount, walker.Pending(), TOTAL_BYTES_READ)
+
 			bckItem := pair.bck.GetItem(refItem)
 			if logLevel >= log.Debug {
 				logger.Debug("Checking", bckItem.RelPath())
 			}
 
-			err = check(refItem, &bckItem)
-			if err != nil {
-				logger.Warningf("%s: %s", refItem.RelPath(), err)
+			err = check(refItem, &bckItem, pair.cutoff)
+			wasDifferent := scoped && previousDiffs.Has(refItem.RelPath())
+			if err == nil {
+				if wasDifferent {
+					scopedResolved = append(scopedResolved, refItem.RelPath())
+				}
+				if stat, _ := refItem.Stat(); !refItem.IsDir() {
+					ledger.Record(refItem.RelPath(), time.Now(), changedAt(*stat))
+				}
+			} else if err == ERR_CHANGED_SINCE_BACKUP {
+				changedCount += 1
+				// It wasn't verified, so a previous difference isn't resolved
+				currentDiffs.Keep(previousDiffs, refItem.RelPath())
+				reporters.Report(&Event{
+					Event:     EVENT_SKIP,
+					Reference: *pair.ref.root,
+					Backup:    *pair.bck.root,
+					Path:      refItem.RelPath(),
+					Reason:    err.Error(),
+				})
+			} else if entry := allowlist.Match(refItem.RelPath(), diffKind(err)); entry != nil {
+				if wasDifferent {
+					scopedResolved = append(scopedResolved, refItem.RelPath())
+				}
+				ackCount += 1
+				ackReasons[entry.Reason] += 1
+				logger.Infof("%s: %s (acknowledged: %s)", refItem.RelPath(), err, entry.Reason)
+				e := differenceEvent(pair, refItem.RelPath(), err)
+				e.Event = EVENT_ACKNOWLEDGED
+				e.Reason = entry.Reason
+				reporters.Report(e)
+			} else {
 				errCount += 1
+				kind := diffKind(err)
+				diffCounts[kind] += 1
+				status := previousDiffs.Classify(refItem.RelPath(), kind)
+				currentDiffs.Differences[refItem.RelPath()] = kind
+				if status == DIFF_NEW {
+					newCount += 1
+				}
+				if status == DIFF_NEW || !checkOpts.OnlyNew {
+					logger.Warningf("%s: %s", refItem.RelPath(), err)
+					e := differenceEvent(pair, refItem.RelPath(), err)
+					e.Status = status
+					reporters.Report(e)
+				} else {
+					// Still in the session log
+					logger.Infof("%s: %s", refItem.RelPath(), err)
+				}
 			}
 			count += 1
 
-			if logLevel >= log.Warning && !bckItem.IsDir() {
+			throttle.MaybeReload()
+
+			if logLevel >= log.Warning && !jsonStdout && !bckItem.IsDir() {
 				now := time.Now()
 				if now.Sub(lastTime).Seconds() > 3 {
 					lastTime = now
@@ -797,6 +1660,9 @@ func _main() int {
 						FormatInt(errCount),
 						rate,
 					)
+					if limits := throttle.Describe(); limits != "" {
+						msg += " [" + limits + "]"
+					}
 
 					_, cols, _ := GetWinSize()
 					path := bckItem.RelPath()
@@ -815,26 +1681,194 @@ func _main() int {
 		now := time.Now()
 		duration := now.Sub(startTime)
 		rate := float64(TOTAL_BYTES_READ) / duration.Seconds() / 1024.0 / 1024.0
-		logger.Infof(
-			"Finished! %s checked, %s errors, and %s bytes in %v (%0.0f files/s, %0.02fGB/s)",
+		summary := fmt.Sprintf(
+			"%s checked, %s errors, %s changed since backup, %s filtered, and %s bytes in %v (%0.0f files/s, %0.02fGB/s)",
 			FormatInt(count),
 			FormatInt(errCount),
+			FormatInt(changedCount),
+			FormatInt(filteredCount),
 			FormatInt(int64(TOTAL_BYTES_READ)),
 			duration,
 			float64(count)/duration.Seconds(),
 			rate,
 		)
+		if stopReason == "" {
+			logger.Infof("Finished! %s", summary)
+		} else {
+			logger.Warningf(
+				"Stopped early (%s)! %s; %s items left for the next run",
+				stopReason,
+				summary,
+				FormatInt(walker.Pending()),
+			)
+		}
+		if errCount > 0 {
+			logger.Warningf("Differences: %s", describeCounts(diffCounts, " "))
+		}
+		if ackCount > 0 {
+			logger.Warningf("Acknowledged differences: %s", describeCounts(ackReasons, " "))
+		}
+		resolved := []string{}
+		if scoped {
+			resolved = scopedResolved
+		} else if stopReason == "" {
+			resolved = previousDiffs.Resolved(currentDiffs)
+		}
+		if previousDiffs != nil && (errCount > 0 || len(resolved) > 0) {
+			logger.Warningf("Since the last complete run: %s new, %s persisting, %s resolved",
+				FormatInt(newCount),
+				FormatInt(errCount-newCount),
+				FormatInt(len(resolved)),
+			)
+		}
+		for _, relPath := range resolved {
+			logger.Infof("Resolved: %s", relPath)
+			reporters.Report(&Event{
+				Event:     EVENT_RESOLVED,
+				Reference: *pair.ref.root,
+				Backup:    *pair.bck.root,
+				Path:      relPath,
+				Kind:      previousDiffs.Differences[relPath],
+				Status:    DIFF_RESOLVED,
+			})
+		}
+		if scoped {
+			err = MergeDifferenceSet(runStatusDir, pair.bckKey, previousDiffs, currentDiffs, resolved)
+		} else {
+			currentDiffs.Finished = now
+			err = SaveDifferenceSet(runStatusDir, pair.bckKey, currentDiffs, stopReason == "")
+		}
+		if err != nil {
+			logger.Errorf("Error saving differences: %s", err)
+		}
+		if filteredCount > 0 {
+			logger.Infof("Filtered: %s", describeCounts(filtered, " by "))
+		}
+		if excludedCount > 0 {
+			logger.Infof("Excluded: %s paths", FormatInt(excludedCount))
+		}
+		if marked := walker.Marked(); len(marked) > 0 {
+			logger.Infof("Skipped %s directories containing marker files:", FormatInt(len(marked)))
+			for _, dir := range marked {
+				logger.Infof("  %s", dir)
+				reporters.Report(&Event{
+					Event:     EVENT_SKIP,
+					Reference: *pair.ref.root,
+					Backup:    *pair.bck.root,
+					Path:      dir,
+					Reason:    "contains a marker file",
+				})
+			}
+		}
 
 		walker.Close()
+		saveLedger()
+
+		result := PairResult{
+			Reference:    refAbs,
+			Backup:       bckAbs,
+			BackupKey:    pair.bckKey,
+			Started:      pairStartTime,
+			Finished:     now,
+			Result:       "finished",
+			Checked:      count,
+			Errors:       errCount,
+			Diffs:        diffCounts,
+			New:          newCount,
+			Resolved:     len(resolved),
+			Acknowledged: ackCount,
+			Changed:      changedCount,
+			Filtered:     filteredCount,
+			Bytes:        TOTAL_BYTES_READ - pairStartBytes,
+			Pending:      walker.Pending(),
+		}
+		if stopReason != "" {
+			result.Result = "stopped early (" + stopReason + ")"
+		}
+		failing := failingKinds(diffCounts, failOn)
+		// Differences are more important than an incomplete run
+		pairStatus := 0
+		if len(failing) > 0 {
+			pairStatus = EXIT_DIFFERENCES
+		} else if stopReason != "" {
+			pairStatus = EXIT_INCOMPLETE
+		}
+		if pairStatus == 0 {
+			result.LastSuccess = now
+		} else if previous, _ := LoadPairResult(runStatusDir); previous != nil {
+			result.LastSuccess = previous.LastSuccess
+		}
+		err = result.Save(runStatusDir)
+		if err != nil {
+			logger.Errorf("Error saving run result: %s", err)
+		}
+		unlock()
+		logPath := ""
+		if sessionLogFile != nil {
+			logPath = sessionLogFileName
+		}
+		reporters.Report(&Event{
+			Event:      EVENT_PAIR_END,
+			Reference:  *pair.ref.root,
+			Backup:     *pair.bck.root,
+			Summary:    &result,
+			Log:        logPath,
+			ExitStatus: &pairStatus,
+		})
+
+		totals.Checked += result.Checked
+		totals.Errors += result.Errors
+		totals.New += result.New
+		totals.Resolved += result.Resolved
+		totals.Acknowledged += result.Acknowledged
+		totals.Changed += result.Changed
+		totals.Filtered += result.Filtered
+		totals.Pending += result.Pending
+		for kind, count := range diffCounts {
+			totals.Diffs[kind] += count
+		}
+		if stopReason != "" {
+			totals.Result = result.Result
+		}
+
 		if errCount > 0 && sessionLogFile != nil {
 			logCleanup()
 			logger.Warning("Errors logged to:", sessionLogFileName)
 		} else {
 			logCleanup()
 		}
+
+		hooks.PairFinished(&result, pairStatus, logPath)
+
+		if pairStatus == EXIT_DIFFERENCES || exitStatus == 0 {
+			exitStatus = pairStatus
+		}
+		if stopReason != "" {
+			err = SaveResumePair(stateDir, pairKeys, idx)
+			if err != nil {
+				logger.Errorf("Error saving the pair to resume from: %s", err)
+			}
+			stopped = true
+			break
+		}
 	}
+	if !stopped {
+		err = SaveResumePair(stateDir, pairKeys, -1)
+		if err != nil {
+			logger.Errorf("Error saving the pair to resume from: %s", err)
+		}
+	}
+
+	totals.Finished = time.Now()
+	totals.Bytes = TOTAL_BYTES_READ
+	reporters.Report(&Event{
+		Event:      EVENT_RUN_END,
+		Time:       totals.Finished,
+		ExitStatus: &exitStatus,
+		Summary:    &totals,
+	})
 
-	return 0
+	return exitStatus
 }
 
 func main() {
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+type RunBudget struct {
+	MaxDuration time.Duration
+	MaxBytes    uint64
+
+	startTime  time.Time
+	stopReason atomic.Value
+}
+
+func NewRunBudget(maxDuration time.Duration, maxBytes uint64) *RunBudget {
+	return &RunBudget{
+		MaxDuration: maxDuration,
+		MaxBytes:    maxBytes,
+		startTime:   time.Now(),
+	}
+}
+
+// Stop asks the run to stop at the next file boundary. It's safe to call
+// from the signal handling goroutine.
+func (b *RunBudget) Stop(reason string) {
+	b.stopReason.Store(reason)
+}
+
+// Exhausted returns the reason the run should stop, or "" if it can keep
+// going.
+func (b *RunBudget) Exhausted() string {
+	if reason, ok := b.stopReason.Load().(string); ok {
+		return reason
+	}
+
+	if b.MaxDuration > 0 && time.Since(b.startTime) >= b.MaxDuration {
+		return fmt.Sprintf("--max-duration of %v reached", b.MaxDuration)
+	}
+
+	if b.MaxBytes > 0 && TOTAL_BYTES_READ >= b.MaxBytes {
+		return fmt.Sprintf("--max-bytes of %s reached", FormatInt(int64(b.MaxBytes)))
+	}
+
+	return ""
+}
+
+// RESUME_PAIR_FILE_NAME is the file in the state directory recording the pair
+// a run of several pairs was stopped in, so the next run of the same pairs
+// picks up from it instead of starting again at the first pair.
+const RESUME_PAIR_FILE_NAME = "resume-pair.json"
+
+type resumePair struct {
+	Pairs []string `json:"pairs"`
+	Next  int      `json:"next"`
+}
+
+// LoadResumePair returns the index of the pair the last run of pairKeys was
+// stopped in, or 0 if it wasn't stopped (or was a run of other pairs).
+func LoadResumePair(stateDir string, pairKeys []string) (int, error) {
+	data, err := ioutil.ReadFile(path.Join(stateDir, RESUME_PAIR_FILE_NAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	saved := resumePair{}
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return 0, err
+	}
+	if !reflect.DeepEqual(saved.Pairs, pairKeys) || saved.Next < 0 || saved.Next >= len(pairKeys) {
+		return 0, nil
+	}
+	return saved.Next, nil
+}
+
+// SaveResumePair records that the run of pairKeys was stopped in the pair at
+// next, or that it finished them all if next is -1.
+func SaveResumePair(stateDir string, pairKeys []string, next int) error {
+	resumePath := path.Join(stateDir, RESUME_PAIR_FILE_NAME)
+	if next < 0 {
+		err := os.Remove(resumePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(resumePair{Pairs: pairKeys, Next: next}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := resumePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, append(data, '\n'), 0600)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, resumePath)
+}
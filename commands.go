@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+// DEFAULT_COMMAND is used when the first argument isn't a command, so
+// "backup-chk REFERENCE_DIR:BACKUP_DIR" keeps working.
+const DEFAULT_COMMAND = "check"
+
+type CheckCommand struct {
+	CheckOptions
+}
+
+func (c *CheckCommand) Usage() string {
+	return "[check-OPTIONS] [REFERENCE_DIR:BACKUP_DIR ...]"
+}
+
+type CoverageCommand struct {
+	PathOptions
+
+	CoverageDays int `long:"coverage-days" description:"The window to report on, in days (default: 30)"`
+}
+
+func (c *CoverageCommand) Usage() string {
+	return "[coverage-OPTIONS] REFERENCE_DIR:BACKUP_DIR ..."
+}
+
+type RunCommand struct {
+	CheckOptions
+}
+
+func (c *RunCommand) Usage() string {
+	return "[run-OPTIONS] PROFILE [REFERENCE_DIR:BACKUP_DIR ...]"
+}
+
+type StatusCommand struct{}
+
+type ResetCommand struct{}
+
+type HistoryCommand struct {
+	Limit int `long:"limit" default:"10" description:"Show this many of the most recent runs of each pair (0 for all)"`
+}
+
+func (c *HistoryCommand) Usage() string {
+	return "[history-OPTIONS] [REFERENCE_DIR ...]"
+}
+
+func (c *ResetCommand) Usage() string {
+	return "[reset-OPTIONS] REFERENCE_DIR ..."
+}
+
+type ExplainCommand struct {
+	PathOptions
+	FilterOptions
+}
+
+func (c *ExplainCommand) Usage() string {
+	return "[explain-OPTIONS] REFERENCE_DIR:BACKUP_DIR PATH ..."
+}
+
+// checkOptions returns the options of the active command, or nil if it
+// doesn't check pairs. The options which coverage and explain don't take
+// are left unset.
+func (o *CmdlineOptions) checkOptions(active *flags.Command) *CheckOptions {
+	if active == nil {
+		return nil
+	}
+	switch active.Name {
+	case "check":
+		return &o.Check.CheckOptions
+	case "coverage":
+		return &CheckOptions{
+			PathOptions:  o.Coverage.PathOptions,
+			CoverageDays: o.Coverage.CoverageDays,
+		}
+	case "run":
+		return &o.Run.CheckOptions
+	case "explain":
+		return &CheckOptions{
+			PathOptions:   o.Explain.PathOptions,
+			FilterOptions: o.Explain.FilterOptions,
+		}
+	}
+	return nil
+}
+
+func newCmdlineParser(opts *CmdlineOptions) *flags.Parser {
+	parser := flags.NewParser(opts, flags.Default)
+	parser.Usage = "[OPTIONS] [-vv]"
+	parser.SubcommandsOptional = true
+	return parser
+}
+
+func optionTakesValue(opt *flags.Option) bool {
+	t := opt.Field().Type
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t.Kind() != reflect.Bool
+}
+
+// commandArgs inserts DEFAULT_COMMAND into args unless they start with a
+// command, skipping over options and their values to find out. It also
+// returns the index of the command in the result (or -1 if there isn't one).
+func commandArgs(parser *flags.Parser, args []string) ([]string, int) {
+	check := parser.Find(DEFAULT_COMMAND)
+	for idx := 0; idx < len(args); idx += 1 {
+		arg := args[idx]
+		if arg == "--" {
+			break
+		}
+
+		if arg == "-" || !strings.HasPrefix(arg, "-") {
+			if parser.Find(arg) != nil {
+				return args, idx
+			}
+			break
+		}
+
+		if arg == "-h" || arg == "--help" {
+			return args, -1
+		}
+
+		if strings.HasPrefix(arg, "--") {
+			if strings.Contains(arg, "=") {
+				continue
+			}
+			opt := check.FindOptionByLongName(arg[2:])
+			if opt != nil && optionTakesValue(opt) {
+				idx += 1
+			}
+			continue
+		}
+
+		// Short options can be combined (ex, "-vvc DIR" or "-cDIR")
+		names := []rune(arg[1:])
+		for nameIdx, name := range names {
+			opt := check.FindOptionByShortName(name)
+			if opt != nil && optionTakesValue(opt) {
+				if nameIdx == len(names)-1 {
+					idx += 1
+				}
+				break
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		return args, -1
+	}
+	return append([]string{DEFAULT_COMMAND}, args...), 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	flags "github.com/jessevdk/go-flags"
+)
+
+const CONFIG_FILE_NAME = "config.toml"
+
+// resolveConfigDirs returns the directory for configuration and the
+// directory for run state. An explicit --config-dir is used for both, as is
+// ~/.backup-chk/ if it exists. Otherwise $XDG_CONFIG_HOME/backup-chk/ and
+// $XDG_STATE_HOME/backup-chk/ are used when those are set.
+func resolveConfigDirs(configDirOpt string) (string, string, error) {
+	if configDirOpt != "" {
+		dir, err := ExpandUser(configDirOpt)
+		return dir, dir, err
+	}
+
+	legacyDir, err := ExpandUser("~/.backup-chk/")
+	if err != nil {
+		return "", "", err
+	}
+	if st, err := os.Stat(legacyDir); err == nil && st.IsDir() {
+		return legacyDir, legacyDir, nil
+	}
+
+	configDir := legacyDir
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); path.IsAbs(xdg) {
+		configDir = path.Join(xdg, "backup-chk")
+	}
+
+	stateDir := configDir
+	if xdg := os.Getenv("XDG_STATE_HOME"); path.IsAbs(xdg) {
+		stateDir = path.Join(xdg, "backup-chk")
+	}
+
+	return configDir, stateDir, nil
+}
+
+// ConfigFile is the contents of config.toml. Each profile maps long option
+// names to their values, plus "pairs" for the REFERENCE_DIR:BACKUP_DIR
+// pairs. For example:
+//
+//	[profiles.laptop]
+//	pairs = ["/Users/:/Volumes/Backup/Users"]
+//	exclude = ["Library/Caches", ".Trash"]
+//	max-duration = "2h"
+type ConfigFile struct {
+	Profiles map[string]map[string]interface{} `toml:"profiles"`
+}
+
+func LoadConfigFile(configDir string) (*ConfigFile, string, error) {
+	configPath := path.Join(configDir, CONFIG_FILE_NAME)
+	res := &ConfigFile{}
+	_, err := toml.DecodeFile(configPath, res)
+	if err != nil {
+		return nil, configPath, err
+	}
+	return res, configPath, nil
+}
+
+// ProfileArgs converts a profile into command line arguments, which are
+// checked against the options known by cmd. Options come first and pairs
+// last, so the profile's options can be overridden from the command line.
+func (c *ConfigFile) ProfileArgs(name string, cmd *flags.Command) ([]string, []string, error) {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		known := []string{}
+		for profileName := range c.Profiles {
+			known = append(known, profileName)
+		}
+		sort.Strings(known)
+		return nil, nil, fmt.Errorf("unknown profile: %s (known profiles: %v)", name, known)
+	}
+
+	keys := make([]string, 0, len(profile))
+	for key := range profile {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	optArgs := []string{}
+	pairs := []string{}
+	for _, key := range keys {
+		val := profile[key]
+		if key == "pairs" {
+			vals, ok := val.([]interface{})
+			if !ok {
+				return nil, nil, errors.New("profile " + name + ": pairs must be a list")
+			}
+			for _, pair := range vals {
+				pairs = append(pairs, fmt.Sprint(pair))
+			}
+			continue
+		}
+
+		if cmd.FindOptionByLongName(key) == nil {
+			return nil, nil, fmt.Errorf("profile %s: unknown option: %s", name, key)
+		}
+
+		vals, isList := val.([]interface{})
+		if !isList {
+			vals = []interface{}{val}
+		}
+		for _, v := range vals {
+			switch v := v.(type) {
+			case bool:
+				if v {
+					optArgs = append(optArgs, "--"+key)
+				}
+			case time.Time:
+				optArgs = append(optArgs, "--"+key+"="+v.Format(time.RFC3339))
+			default:
+				optArgs = append(optArgs, "--"+key+"="+fmt.Sprint(v))
+			}
+		}
+	}
+
+	return optArgs, pairs, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileCtime returns the inode change time, falling back to the modification
+// time when it isn't available.
+func fileCtime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(int64(st.Ctimespec.Sec), int64(st.Ctimespec.Nsec))
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+func fileCtime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
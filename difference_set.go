@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// The differences of the last complete run of a pair, and of the runs since
+// then which were stopped early, in the reference directory's run status
+// directory, followed by the run status name of the backup directory.
+const (
+	DIFFERENCES_FILE_PREFIX         = "differences-"
+	PARTIAL_DIFFERENCES_FILE_PREFIX = "partial-differences-"
+)
+
+// How a difference compares to the previous complete run
+const (
+	DIFF_NEW        = "new"
+	DIFF_PERSISTING = "persisting"
+	DIFF_RESOLVED   = "resolved"
+)
+
+// DifferenceSet is the kind of difference found at each path of a pair.
+type DifferenceSet struct {
+	Finished    time.Time         `json:"finished"`
+	Differences map[string]string `json:"differences"`
+}
+
+func NewDifferenceSet() *DifferenceSet {
+	return &DifferenceSet{Differences: map[string]string{}}
+}
+
+func loadDifferenceSet(filePath string) (*DifferenceSet, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	res := NewDifferenceSet()
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Differences == nil {
+		res.Differences = map[string]string{}
+	}
+	return res, nil
+}
+
+func (s *DifferenceSet) save(filePath string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, append(data, '\n'), 0600)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+// differencesPaths returns the paths of the complete and partial differences
+// of the backup directory bckKey.
+func differencesPaths(runStatusDir string, bckKey string) (string, string, error) {
+	name, err := runStatusName(bckKey)
+	if err != nil {
+		return "", "", err
+	}
+	return path.Join(runStatusDir, DIFFERENCES_FILE_PREFIX+name+".json"),
+		path.Join(runStatusDir, PARTIAL_DIFFERENCES_FILE_PREFIX+name+".json"), nil
+}
+
+// LoadDifferenceSets loads the differences of the last complete run (nil if
+// there hasn't been one), and those found since then by runs which were
+// stopped early (empty if there weren't any).
+func LoadDifferenceSets(runStatusDir string, bckKey string) (*DifferenceSet, *DifferenceSet, error) {
+	completePath, partialPath, err := differencesPaths(runStatusDir, bckKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous, err := loadDifferenceSet(completePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	partial, err := loadDifferenceSet(partialPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if partial == nil {
+		partial = NewDifferenceSet()
+	}
+	return previous, partial, nil
+}
+
+// Classify returns DIFF_NEW if the previous complete run didn't find the same
+// kind of difference at relPath, or DIFF_PERSISTING if it did. Every
+// difference is new if there hasn't been a complete run.
+func (s *DifferenceSet) Classify(relPath string, kind string) string {
+	if s != nil && s.Differences[relPath] == kind {
+		return DIFF_PERSISTING
+	}
+	return DIFF_NEW
+}
+
+// Has is true if the previous complete run found a difference at relPath.
+func (s *DifferenceSet) Has(relPath string) bool {
+	_, ok := s.kind(relPath)
+	return ok
+}
+
+// Keep copies previous's difference at relPath (if it has one) to s, for
+// paths which weren't verified, so they aren't resolved.
+func (s *DifferenceSet) Keep(previous *DifferenceSet, relPath string) {
+	if kind, ok := previous.kind(relPath); ok {
+		s.Differences[relPath] = kind
+	}
+}
+
+func (s *DifferenceSet) kind(relPath string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	kind, ok := s.Differences[relPath]
+	return kind, ok
+}
+
+// Resolved returns the paths of the previous complete run's differences
+// which current doesn't have, sorted.
+func (s *DifferenceSet) Resolved(current *DifferenceSet) []string {
+	if s == nil {
+		return nil
+	}
+	res := []string{}
+	for relPath := range s.Differences {
+		if _, ok := current.Differences[relPath]; !ok {
+			res = append(res, relPath)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// SaveDifferenceSet saves the differences of a run of the whole tree. If it
+// was stopped early they're kept until the run which finishes the walk, which
+// saves them all as the differences of the complete run.
+func SaveDifferenceSet(runStatusDir string, bckKey string, current *DifferenceSet, complete bool) error {
+	completePath, partialPath, err := differencesPaths(runStatusDir, bckKey)
+	if err != nil {
+		return err
+	}
+	if !complete {
+		return current.save(partialPath)
+	}
+	err = current.save(completePath)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(partialPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MergeDifferenceSet adds the differences found by a run which only checked
+// part of the tree (ex, with --include or filters) to those of the last
+// complete run, and removes the resolved paths it checked. It does nothing if
+// there hasn't been a complete run.
+func MergeDifferenceSet(runStatusDir string, bckKey string, previous *DifferenceSet, found *DifferenceSet, resolved []string) error {
+	if previous == nil {
+		return nil
+	}
+	completePath, _, err := differencesPaths(runStatusDir, bckKey)
+	if err != nil {
+		return err
+	}
+	for relPath, kind := range found.Differences {
+		previous.Differences[relPath] = kind
+	}
+	for _, relPath := range resolved {
+		delete(previous.Differences, relPath)
+	}
+	return previous.save(completePath)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func differenceSetOf(diffs map[string]string) *DifferenceSet {
+	res := NewDifferenceSet()
+	for relPath, kind := range diffs {
+		res.Differences[relPath] = kind
+	}
+	return res
+}
+
+func TestDifferenceSetClassify(t *testing.T) {
+	previous := differenceSetOf(map[string]string{"a": DIFF_SIZE, "b": DIFF_MISSING})
+	tests := []struct {
+		relPath  string
+		kind     string
+		expected string
+	}{
+		{"a", DIFF_SIZE, DIFF_PERSISTING},
+		{"a", DIFF_MISSING, DIFF_NEW},
+		{"b", DIFF_MISSING, DIFF_PERSISTING},
+		{"c", DIFF_SIZE, DIFF_NEW},
+	}
+	for _, test := range tests {
+		if res := previous.Classify(test.relPath, test.kind); res != test.expected {
+			t.Errorf("%s (%s): got %s, expected %s", test.relPath, test.kind, res, test.expected)
+		}
+	}
+
+	// Every difference is new without a complete run
+	var none *DifferenceSet
+	if res := none.Classify("a", DIFF_SIZE); res != DIFF_NEW {
+		t.Errorf("got %s without a complete run, expected %s", res, DIFF_NEW)
+	}
+	if none.Has("a") || none.Resolved(previous) != nil {
+		t.Errorf("expected nothing to be found or resolved without a complete run")
+	}
+}
+
+func TestDifferenceSetResolved(t *testing.T) {
+	previous := differenceSetOf(map[string]string{"c": DIFF_SIZE, "a": DIFF_SIZE, "b": DIFF_MISSING})
+	current := differenceSetOf(map[string]string{"b": DIFF_SIZE, "d": DIFF_CONTENT})
+	res := previous.Resolved(current)
+	if !reflect.DeepEqual(res, []string{"a", "c"}) {
+		t.Errorf("got %q, expected [a c]", res)
+	}
+
+	// Paths which weren't verified keep their previous difference
+	current.Keep(previous, "c")
+	current.Keep(previous, "e")
+	current.Keep(nil, "a")
+	res = previous.Resolved(current)
+	if !reflect.DeepEqual(res, []string{"a"}) || current.Differences["c"] != DIFF_SIZE || current.Has("e") {
+		t.Errorf("got %q resolved and %v, expected [a] and c kept", res, current.Differences)
+	}
+}
+
+func TestMergeDifferenceSet(t *testing.T) {
+	dir := t.TempDir()
+
+	// Nothing is saved without a complete run to merge into
+	err := MergeDifferenceSet(dir, "/bck", nil, differenceSetOf(map[string]string{"a": DIFF_SIZE}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, _, err := LoadDifferenceSets(dir, "/bck")
+	if err != nil || previous != nil {
+		t.Fatalf("got %v (%v), expected no complete run", previous, err)
+	}
+
+	complete := differenceSetOf(map[string]string{"a": DIFF_SIZE, "b": DIFF_MISSING, "c": DIFF_CONTENT})
+	err = SaveDifferenceSet(dir, "/bck", complete, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, _, err = LoadDifferenceSets(dir, "/bck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := differenceSetOf(map[string]string{"b": DIFF_SIZE, "d": DIFF_MODE})
+	err = MergeDifferenceSet(dir, "/bck", previous, found, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, _, err := LoadDifferenceSets(dir, "/bck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"b": DIFF_SIZE, "c": DIFF_CONTENT, "d": DIFF_MODE}
+	if !reflect.DeepEqual(merged.Differences, expected) {
+		t.Errorf("got %v, expected %v", merged.Differences, expected)
+	}
+
+	// Other backups of the reference have their own differences
+	other, _, err := LoadDifferenceSets(dir, "/bck2")
+	if err != nil || other != nil {
+		t.Errorf("got %v (%v) for another backup, expected no complete run", other, err)
+	}
+}
+
+func TestDifferenceSetPartialRuns(t *testing.T) {
+	dir := t.TempDir()
+	err := SaveDifferenceSet(dir, "/bck", differenceSetOf(map[string]string{"a": DIFF_SIZE}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A run which is stopped early doesn't replace the complete run's
+	// differences, and the next run carries on from its own
+	_, partial, err := LoadDifferenceSets(dir, "/bck")
+	if err != nil || len(partial.Differences) != 0 {
+		t.Fatalf("got %v (%v), expected no partial differences", partial, err)
+	}
+	partial.Differences["b"] = DIFF_MISSING
+	err = SaveDifferenceSet(dir, "/bck", partial, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, partial, err := LoadDifferenceSets(dir, "/bck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(previous.Differences, map[string]string{"a": DIFF_SIZE}) {
+		t.Errorf("got %v, expected the complete run's differences", previous.Differences)
+	}
+	if !reflect.DeepEqual(partial.Differences, map[string]string{"b": DIFF_MISSING}) {
+		t.Errorf("got %v, expected the stopped run's differences", partial.Differences)
+	}
+
+	// The run which finishes the walk saves them all, and resolves the rest
+	partial.Differences["c"] = DIFF_CONTENT
+	if res := previous.Resolved(partial); !reflect.DeepEqual(res, []string{"a"}) {
+		t.Errorf("got %q resolved, expected [a]", res)
+	}
+	err = SaveDifferenceSet(dir, "/bck", partial, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, partial, err = LoadDifferenceSets(dir, "/bck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"b": DIFF_MISSING, "c": DIFF_CONTENT}
+	if !reflect.DeepEqual(previous.Differences, expected) || len(partial.Differences) != 0 {
+		t.Errorf("got %v and %v partial, expected %v", previous.Differences, partial.Differences, expected)
+	}
+	_, partialPath, _ := differencesPaths(dir, "/bck")
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Errorf("the partial differences weren't removed (%v)", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Kinds of Difference. DIFF_ERROR is used for anything check returns which
+// isn't a Difference (ex, a file which can't be read).
+const (
+	DIFF_MISSING  = "missing"
+	DIFF_TYPE     = "type"
+	DIFF_MODE     = "mode"
+	DIFF_SYMLINK  = "symlink"
+	DIFF_SIZE     = "size"
+	DIFF_CONTENT  = "content"
+	DIFF_STALE    = "stale-backup"
+	DIFF_ERROR    = "error"
+	DIFF_NO_VALUE = "-"
+)
+
+var diffKinds = map[string]bool{
+	DIFF_MISSING: true,
+	DIFF_TYPE:    true,
+	DIFF_MODE:    true,
+	DIFF_SYMLINK: true,
+	DIFF_SIZE:    true,
+	DIFF_CONTENT: true,
+	DIFF_STALE:   true,
+	DIFF_ERROR:   true,
+}
+
+// Difference is returned by check when the backup doesn't match the
+// reference.
+type Difference struct {
+	Kind      string
+	Reference string
+	Backup    string
+	// The offset of the first chunk which doesn't match, or -1
+	Offset int64
+
+	msg string
+}
+
+func (d *Difference) Error() string {
+	if d.Reference == DIFF_NO_VALUE && d.Backup == DIFF_NO_VALUE {
+		return d.msg
+	}
+	return fmt.Sprintf("%s: reference %s != backup %s", d.msg, d.Reference, d.Backup)
+}
+
+func checkError(kind string, reference interface{}, backup interface{}, msg string) *Difference {
+	return &Difference{
+		Kind:      kind,
+		Reference: fmt.Sprint(reference),
+		Backup:    fmt.Sprint(backup),
+		Offset:    -1,
+		msg:       msg,
+	}
+}
+
+// missingError is the Difference for a backup which can't be found.
+func missingError(err error) error {
+	if !os.IsNotExist(err) {
+		return err
+	}
+	return &Difference{
+		Kind:      DIFF_MISSING,
+		Reference: DIFF_NO_VALUE,
+		Backup:    DIFF_NO_VALUE,
+		Offset:    -1,
+		msg:       err.Error(),
+	}
+}
+
+// diffKind returns the kind of difference err (as returned by check) is.
+func diffKind(err error) string {
+	if diff, ok := err.(*Difference); ok {
+		return diff.Kind
+	}
+	return DIFF_ERROR
+}
+
+// parseFailOn parses --fail-on values, which are lists of difference kinds
+// separated by commas. Every kind fails if none are given.
+func parseFailOn(values []string) (map[string]bool, error) {
+	if len(values) == 0 {
+		return diffKinds, nil
+	}
+
+	res := map[string]bool{}
+	for _, value := range values {
+		for _, kind := range strings.Split(value, ",") {
+			kind = strings.TrimSpace(kind)
+			if kind == "" {
+				continue
+			}
+			if !diffKinds[kind] {
+				known := []string{}
+				for k := range diffKinds {
+					known = append(known, k)
+				}
+				sort.Strings(known)
+				return nil, fmt.Errorf("unknown difference kind in --fail-on: %s (known kinds: %s)", kind, strings.Join(known, ", "))
+			}
+			res[kind] = true
+		}
+	}
+	return res, nil
+}
+
+// failingKinds returns the kinds in counts which are in failOn.
+func failingKinds(counts map[string]int, failOn map[string]bool) []string {
+	res := []string{}
+	for kind, count := range counts {
+		if count > 0 && failOn[kind] {
+			res = append(res, kind)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
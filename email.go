@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Email policies
+const (
+	EMAIL_ALWAYS  = "always"
+	EMAIL_FAILURE = "failure"
+	EMAIL_WEEKLY  = "weekly"
+)
+
+// EMAIL_DIGEST_FILE_NAME holds the runs which will be sent in the next weekly
+// digest, in the state directory.
+const EMAIL_DIGEST_FILE_NAME = "email-digest.json"
+
+const EMAIL_DIGEST_PERIOD = 7 * 24 * time.Hour
+
+// SMTPOptions are how to send email.
+type SMTPOptions struct {
+	Server   string
+	User     string
+	Password string
+	TLS      string
+	From     string
+	To       []string
+}
+
+type emailPair struct {
+	Reference   string      `json:"reference"`
+	Backup      string      `json:"backup"`
+	Summary     *PairResult `json:"summary,omitempty"`
+	Log         string      `json:"log,omitempty"`
+	Differences []*Event    `json:"differences,omitempty"`
+	Omitted     int         `json:"omitted,omitempty"`
+}
+
+type emailRun struct {
+	Started    time.Time    `json:"started"`
+	Finished   time.Time    `json:"finished"`
+	ExitStatus int          `json:"exit_status"`
+	Pairs      []*emailPair `json:"pairs"`
+}
+
+type emailDigest struct {
+	Since time.Time   `json:"since"`
+	Runs  []*emailRun `json:"runs"`
+}
+
+// EmailReport emails a summary of the run when it's done: after every run,
+// only after runs which fail, or as a weekly digest of every run.
+type EmailReport struct {
+	smtp       SMTPOptions
+	policy     string
+	maxDiffs   int
+	digestPath string
+	host       string
+
+	run   *emailRun
+	pair  *emailPair
+	ended bool
+}
+
+func NewEmailReport(opts SMTPOptions, policy string, maxDiffs int, stateDir string) (*EmailReport, error) {
+	if _, _, err := net.SplitHostPort(opts.Server); err != nil {
+		return nil, fmt.Errorf("invalid --smtp-server (expected HOST:PORT): %s", opts.Server)
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	if opts.From == "" {
+		opts.From = "backup-chk@" + host
+	}
+
+	var to []string
+	for _, addrs := range opts.To {
+		for _, addr := range strings.Split(addrs, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				to = append(to, addr)
+			}
+		}
+	}
+	opts.To = to
+
+	return &EmailReport{
+		smtp:       opts,
+		policy:     policy,
+		maxDiffs:   maxDiffs,
+		digestPath: path.Join(stateDir, EMAIL_DIGEST_FILE_NAME),
+		host:       host,
+	}, nil
+}
+
+func (r *EmailReport) Report(e *Event) {
+	switch e.Event {
+	case EVENT_RUN_START:
+		r.run = &emailRun{Started: e.Time}
+	case EVENT_PAIR_START:
+		if r.run == nil {
+			return
+		}
+		r.pair = &emailPair{Reference: e.Reference, Backup: e.Backup}
+		r.run.Pairs = append(r.run.Pairs, r.pair)
+	case EVENT_DIFFERENCE:
+		if r.pair == nil {
+			return
+		}
+		if len(r.pair.Differences) < r.maxDiffs {
+			r.pair.Differences = append(r.pair.Differences, e)
+		} else {
+			r.pair.Omitted += 1
+		}
+	case EVENT_PAIR_END:
+		if r.pair != nil {
+			r.pair.Summary = e.Summary
+			r.pair.Log = e.Log
+		}
+	case EVENT_RUN_END:
+		if r.run == nil {
+			return
+		}
+		r.ended = true
+		r.run.Finished = e.Time
+		if e.ExitStatus != nil {
+			r.run.ExitStatus = *e.ExitStatus
+		}
+	}
+}
+
+// Close sends the email, if the policy says so. A run which started but
+// didn't end (ex, because of a fatal error) has failed.
+func (r *EmailReport) Close() error {
+	if r.run == nil {
+		return nil
+	}
+	if !r.ended {
+		r.run.Finished = time.Now()
+		r.run.ExitStatus = 1
+	}
+
+	switch r.policy {
+	case EMAIL_FAILURE:
+		if r.run.ExitStatus == 0 {
+			return nil
+		}
+	case EMAIL_WEEKLY:
+		return r.addToDigest()
+	}
+
+	return r.send(&emailDigest{Since: r.run.Started, Runs: []*emailRun{r.run}})
+}
+
+// addToDigest saves the run for the weekly digest, and sends the digest if
+// it's been a week since the last one.
+func (r *EmailReport) addToDigest() error {
+	digest := &emailDigest{}
+	data, err := ioutil.ReadFile(r.digestPath)
+	if err == nil {
+		err = json.Unmarshal(data, digest)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warningf("Error loading email digest (starting a new one): %s", err)
+		digest = &emailDigest{}
+	}
+	if digest.Since.IsZero() {
+		digest.Since = r.run.Started
+	}
+	digest.Runs = append(digest.Runs, r.run)
+
+	if r.run.Finished.Sub(digest.Since) >= EMAIL_DIGEST_PERIOD {
+		err = r.send(digest)
+		if err != nil {
+			return err
+		}
+		digest = &emailDigest{Since: r.run.Finished}
+	}
+
+	data, err = json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+	tmpPath := r.digestPath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, r.digestPath)
+}
+
+func describeExitStatus(status int) string {
+	switch status {
+	case 0:
+		return "ok"
+	case EXIT_DIFFERENCES:
+		return "differences found"
+	case EXIT_INCOMPLETE:
+		return "incomplete"
+	}
+	return "failed"
+}
+
+func (r *EmailReport) subject(digest *emailDigest) string {
+	if r.policy == EMAIL_WEEKLY {
+		failed := 0
+		for _, run := range digest.Runs {
+			if run.ExitStatus != 0 {
+				failed += 1
+			}
+		}
+		return fmt.Sprintf("backup-chk on %s: weekly digest, %d runs, %d not ok", r.host, len(digest.Runs), failed)
+	}
+	return fmt.Sprintf("backup-chk on %s: %s", r.host, describeExitStatus(digest.Runs[0].ExitStatus))
+}
+
+var emailFuncs = map[string]interface{}{
+	"status":   describeExitStatus,
+	"describe": func(e *Event) string { return e.describe() },
+}
+
+var emailTextTemplate = template.Must(template.New("text").Funcs(template.FuncMap(htmlReportFuncs)).Funcs(emailFuncs).Parse(`{{ .Subject }}
+{{ range .Runs }}
+Run started {{ time .Started }}, finished {{ time .Finished }}: {{ status .ExitStatus }} (exit status {{ .ExitStatus }})
+{{ range .Pairs }}
+{{ .Reference }} -> {{ .Backup }}
+{{ with .Summary }}  {{ .Result }}: {{ int .Checked }} checked, {{ int .Errors }} differences{{ if .Diffs }} ({{ counts .Diffs }}){{ end }}, {{ int .Changed }} changed since backup, {{ int .Filtered }} filtered, {{ int .Bytes }} bytes in {{ duration . }}{{ if .Pending }}; {{ int .Pending }} items left for the next run{{ end }}
+{{ else }}  Didn't finish.
+{{ end }}{{ if .Log }}  Log: {{ .Log }}
+{{ end }}{{ range .Differences }}    {{ .Path }}: {{ .Kind }}: {{ describe . }}
+{{ end }}{{ if .Omitted }}    ... and {{ int .Omitted }} more
+{{ end }}{{ end }}{{ end }}`))
+
+var emailHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Funcs(htmlReportFuncs).Funcs(emailFuncs).Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: -apple-system, 'Segoe UI', Helvetica, Arial, sans-serif; color: #222;">
+<h2>{{ .Subject }}</h2>
+{{ range .Runs }}
+<p><b>Run started {{ time .Started }}, finished {{ time .Finished }}:</b>
+<span style="color: {{ if .ExitStatus }}#b02a2a{{ else }}#2a7a2a{{ end }};">{{ status .ExitStatus }}</span> (exit status {{ .ExitStatus }})</p>
+{{ range .Pairs }}
+<h3 style="font-family: Menlo, Consolas, monospace; font-size: 1em;">{{ .Reference }} &rarr; {{ .Backup }}</h3>
+{{ with .Summary }}<p>{{ .Result }}: {{ int .Checked }} checked, {{ int .Errors }} differences{{ if .Diffs }} ({{ counts .Diffs }}){{ end }}, {{ int .Changed }} changed since backup, {{ int .Filtered }} filtered, {{ int .Bytes }} bytes in {{ duration . }}{{ if .Pending }}; {{ int .Pending }} items left for the next run{{ end }}</p>
+{{ else }}<p>Didn't finish.</p>
+{{ end }}{{ if .Log }}<p>Log: <code>{{ .Log }}</code></p>
+{{ end }}{{ if .Differences }}<ul>
+{{ range .Differences }}<li><code>{{ .Path }}</code>: {{ .Kind }}: {{ describe . }}</li>
+{{ end }}{{ if .Omitted }}<li>... and {{ int .Omitted }} more</li>
+{{ end }}</ul>
+{{ end }}{{ end }}{{ end }}
+</body>
+</html>
+`))
+
+func writeEmailPart(mw *multipart.Writer, contentType string, body []byte) error {
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	_, err = qp.Write(body)
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// message formats digest as a multipart/alternative email.
+func (r *EmailReport) message(digest *emailDigest) ([]byte, error) {
+	data := map[string]interface{}{
+		"Subject": r.subject(digest),
+		"Runs":    digest.Runs,
+	}
+	text := &bytes.Buffer{}
+	err := emailTextTemplate.Execute(text, data)
+	if err != nil {
+		return nil, err
+	}
+	html := &bytes.Buffer{}
+	err = emailHTMLTemplate.Execute(html, data)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	err = writeEmailPart(mw, "text/plain", text.Bytes())
+	if err == nil {
+		err = writeEmailPart(mw, "text/html", html.Bytes())
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", r.smtp.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(r.smtp.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", data["Subject"].(string)))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: multipart/alternative; boundary=%s\r\n", mw.Boundary())
+	fmt.Fprintf(msg, "\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func (r *EmailReport) send(digest *emailDigest) error {
+	msg, err := r.message(digest)
+	if err != nil {
+		return err
+	}
+	err = sendMail(r.smtp, msg)
+	if err != nil {
+		return fmt.Errorf("error sending email via %s: %s", r.smtp.Server, err)
+	}
+	logger.Infof("Emailed report to: %s", strings.Join(r.smtp.To, ", "))
+	return nil
+}
+
+// sendMail sends msg, using STARTTLS unless opts.TLS is "none". Unlike
+// smtp.SendMail, it won't fall back to plain text if STARTTLS isn't offered.
+func sendMail(opts SMTPOptions, msg []byte) error {
+	host, _, err := net.SplitHostPort(opts.Server)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.Dial(opts.Server)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if opts.TLS != "none" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server doesn't support STARTTLS (use --smtp-tls none to send without it)")
+		}
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.User != "" {
+		err = c.Auth(smtp.PlainAuth("", opts.User, opts.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(opts.From)
+	if err != nil {
+		return err
+	}
+	for _, addr := range opts.To {
+		err = c.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type smtpMail struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// smtpStub is just enough of an SMTP server to receive mail, without TLS.
+type smtpStub struct {
+	listener net.Listener
+
+	lock  sync.Mutex
+	mails []*smtpMail
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStub{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStub) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *smtpStub) Close() {
+	s.listener.Close()
+}
+
+func (s *smtpStub) received() []*smtpMail {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*smtpMail{}, s.mails...)
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	c.PrintfLine("220 stub ESMTP")
+	m := &smtpMail{}
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 stub")
+		case "MAIL":
+			m.from = strings.TrimPrefix(line, "MAIL FROM:")
+			c.PrintfLine("250 ok")
+		case "RCPT":
+			m.to = append(m.to, strings.TrimPrefix(line, "RCPT TO:"))
+			c.PrintfLine("250 ok")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			m.data, err = c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.mails = append(s.mails, m)
+			s.lock.Unlock()
+			m = &smtpMail{}
+			c.PrintfLine("250 ok")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	s := newSMTPStub(t)
+	defer s.Close()
+
+	opts := SMTPOptions{
+		Server: s.addr(),
+		TLS:    "none",
+		From:   "backup-chk@example.com",
+		To:     []string{"a@example.com", "b@example.com"},
+	}
+	err := sendMail(opts, []byte("Subject: hi\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails := s.received()
+	if len(mails) != 1 {
+		t.Fatalf("got %d mails, expected 1", len(mails))
+	}
+	if mails[0].from != "<backup-chk@example.com>" || len(mails[0].to) != 2 || mails[0].to[1] != "<b@example.com>" {
+		t.Errorf("unexpected envelope: %+v", mails[0])
+	}
+	if !bytes.Contains(mails[0].data, []byte("hello")) {
+		t.Errorf("unexpected data: %q", mails[0].data)
+	}
+
+	// STARTTLS is required unless the TLS option is "none"
+	opts.TLS = ""
+	err = sendMail(opts, []byte("Subject: hi\r\n\r\nhello\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("got %v, expected a STARTTLS error", err)
+	}
+	if len(s.received()) != 1 {
+		t.Errorf("mail was sent without STARTTLS")
+	}
+}
+
+// reportRun sends the events of a run which started at started, and found a
+// difference at each of paths.
+func reportRun(r *EmailReport, started time.Time, exitStatus int, paths ...string) {
+	r.Report(&Event{Event: EVENT_RUN_START, Time: started})
+	r.Report(&Event{Event: EVENT_PAIR_START, Reference: "/ref", Backup: "/bck"})
+	for _, p := range paths {
+		r.Report(&Event{Event: EVENT_DIFFERENCE, Path: p, Kind: DIFF_SIZE, Message: "size mismatch"})
+	}
+	r.Report(&Event{Event: EVENT_PAIR_END, Summary: &PairResult{
+		Reference: "/ref",
+		Backup:    "/bck",
+		Started:   started,
+		Finished:  started.Add(time.Hour),
+		Result:    "finished",
+		Checked:   10,
+		Errors:    len(paths),
+	}})
+	r.Report(&Event{Event: EVENT_RUN_END, Time: started.Add(time.Hour), ExitStatus: &exitStatus})
+}
+
+// mailParts returns the decoded parts of a multipart/alternative mail, by
+// content type.
+func mailParts(t *testing.T, data []byte) (*mail.Message, map[string]string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got Content-Type %q (%v), expected multipart/alternative", msg.Header.Get("Content-Type"), err)
+	}
+	res := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		res[contentType] = string(body)
+	}
+	return msg, res
+}
+
+func TestEmailReport(t *testing.T) {
+	s := newSMTPStub(t)
+	defer s.Close()
+
+	opts := SMTPOptions{Server: s.addr(), TLS: "none", To: []string{"a@example.com, b@example.com"}}
+	r, err := NewEmailReport(opts, EMAIL_ALWAYS, 1, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportRun(r, time.Now(), EXIT_DIFFERENCES, "a/long-enough-path-that-quoted-printable-has-to-wrap-the-line-somewhere", "b")
+	err = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mails := s.received()
+	if len(mails) != 1 {
+		t.Fatalf("got %d mails, expected 1", len(mails))
+	}
+	if !bytes.Contains(mails[0].data, []byte("Content-Transfer-Encoding: quoted-printable")) {
+		t.Errorf("parts aren't quoted-printable: %s", mails[0].data)
+	}
+	msg, parts := mailParts(t, mails[0].data)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || !strings.HasSuffix(subject, ": differences found") {
+		t.Errorf("unexpected subject: %q (%v)", subject, err)
+	}
+	if msg.Header.Get("To") != "a@example.com, b@example.com" {
+		t.Errorf("unexpected To: %q", msg.Header.Get("To"))
+	}
+	for _, contentType := range []string{"text/plain", "text/html"} {
+		body := parts[contentType]
+		if !strings.Contains(body, "a/long-enough-path-that-quoted-printable-has-to-wrap-the-line-somewhere") {
+			t.Errorf("%s part doesn't have the difference: %q", contentType, body)
+		}
+		if !strings.Contains(body, "... and 1 more") {
+			t.Errorf("%s part doesn't have the omitted differences: %q", contentType, body)
+		}
+	}
+
+	// Successful runs aren't sent with the failure policy
+	r, err = NewEmailReport(opts, EMAIL_FAILURE, 10, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportRun(r, time.Now(), 0)
+	err = r.Close()
+	if err != nil || len(s.received()) != 1 {
+		t.Errorf("a successful run was sent with the failure policy (%v)", err)
+	}
+}
+
+func loadEmailDigest(t *testing.T, stateDir string) *emailDigest {
+	data, err := ioutil.ReadFile(path.Join(stateDir, EMAIL_DIGEST_FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &emailDigest{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestEmailWeeklyDigest(t *testing.T) {
+	s := newSMTPStub(t)
+	defer s.Close()
+	stateDir := t.TempDir()
+	opts := SMTPOptions{Server: s.addr(), TLS: "none", To: []string{"a@example.com"}}
+	first := time.Date(2026, 10, 1, 3, 0, 0, 0, time.UTC)
+
+	runs := []struct {
+		started    time.Time
+		exitStatus int
+	}{
+		{first, EXIT_DIFFERENCES},
+		{first.Add(24 * time.Hour), 0},
+		{first.Add(EMAIL_DIGEST_PERIOD), 0},
+	}
+	for idx, run := range runs {
+		r, err := NewEmailReport(opts, EMAIL_WEEKLY, 10, stateDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reportRun(r, run.started, run.exitStatus, "c")
+		err = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if idx < len(runs)-1 {
+			if len(s.received()) != 0 {
+				t.Fatalf("run %d: the digest was sent before a week had passed", idx)
+			}
+			digest := loadEmailDigest(t, stateDir)
+			if !digest.Since.Equal(first) || len(digest.Runs) != idx+1 {
+				t.Errorf("run %d: unexpected digest: since %s, %d runs", idx, digest.Since, len(digest.Runs))
+			}
+		}
+	}
+
+	mails := s.received()
+	if len(mails) != 1 {
+		t.Fatalf("got %d mails, expected the digest", len(mails))
+	}
+	msg, _ := mailParts(t, mails[0].data)
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if !strings.HasSuffix(subject, ": weekly digest, 3 runs, 1 not ok") {
+		t.Errorf("unexpected subject: %q", subject)
+	}
+
+	// The digest starts again after it's sent
+	digest := loadEmailDigest(t, stateDir)
+	last := runs[len(runs)-1].started.Add(time.Hour)
+	if !digest.Since.Equal(last) || len(digest.Runs) != 0 {
+		t.Errorf("unexpected digest after sending: since %s, %d runs", digest.Since, len(digest.Runs))
+	}
+
+	// A corrupt digest is replaced by a new one
+	err := ioutil.WriteFile(path.Join(stateDir, EMAIL_DIGEST_FILE_NAME), []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewEmailReport(opts, EMAIL_WEEKLY, 10, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reportRun(r, last.Add(time.Hour), 0)
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if digest := loadEmailDigest(t, stateDir); len(digest.Runs) != 1 {
+		t.Errorf("got %d runs in the digest, expected 1", len(digest.Runs))
+	}
+	if _, err := os.Stat(path.Join(stateDir, EMAIL_DIGEST_FILE_NAME+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("the digest's temporary file was left behind")
+	}
+}
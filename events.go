@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of Event
+const (
+	EVENT_RUN_START    = "run-start"
+	EVENT_PAIR_START   = "pair-start"
+	EVENT_DIFFERENCE   = "difference"
+	EVENT_SKIP         = "skip"
+	EVENT_RESOLVED     = "resolved"
+	EVENT_ACKNOWLEDGED = "acknowledged"
+	EVENT_PAIR_END     = "pair-end"
+	EVENT_RUN_END      = "run-end"
+)
+
+// Event is something which happened during a run. Only the fields which
+// make sense for each kind of event are set.
+type Event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// The pair being checked
+	Reference string `json:"reference,omitempty"`
+	Backup    string `json:"backup,omitempty"`
+
+	// Differences (and acknowledged differences) and skips
+	Path           string `json:"path,omitempty"`
+	Kind           string `json:"kind,omitempty"`
+	ReferenceValue string `json:"reference_value,omitempty"`
+	BackupValue    string `json:"backup_value,omitempty"`
+	Offset         *int64 `json:"offset,omitempty"`
+	Message        string `json:"message,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+
+	// For differences and resolved, compared to the last complete run
+	Status string `json:"status,omitempty"`
+
+	// Runs
+	Pairs      []string `json:"pairs,omitempty"`
+	Options    []string `json:"options,omitempty"`
+	ExitStatus *int     `json:"exit_status,omitempty"`
+
+	// Totals for pair-end and run-end, and the pair's session log
+	Summary *PairResult `json:"summary,omitempty"`
+	Log     string      `json:"log,omitempty"`
+}
+
+// Options whose values are secret, or URLs which may contain credentials
+var (
+	secretOptions = map[string]bool{"--smtp-password": true}
+	urlOptions    = map[string]bool{"--webhook": true, "--pushgateway": true}
+)
+
+// redactOptions returns the command line arguments of a run without the
+// values of secret options, so they can be written to events and reports.
+func redactOptions(args []string) []string {
+	res := make([]string, 0, len(args))
+	redact := func(name string, val string) string {
+		if secretOptions[name] {
+			return "REDACTED"
+		}
+		if u, err := url.Parse(val); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+		return val
+	}
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		if arg == "--" {
+			res = append(res, args[idx:]...)
+			break
+		}
+		bits := strings.SplitN(arg, "=", 2)
+		name := bits[0]
+		if !secretOptions[name] && !urlOptions[name] {
+			res = append(res, arg)
+			continue
+		}
+		if len(bits) == 2 {
+			res = append(res, name+"="+redact(name, bits[1]))
+			continue
+		}
+		res = append(res, arg)
+		if idx+1 < len(args) {
+			idx++
+			res = append(res, redact(name, args[idx]))
+		}
+	}
+	return res
+}
+
+// differenceEvent describes err, as returned by check for relPath.
+func differenceEvent(pair Pair, relPath string, err error) *Event {
+	e := &Event{
+		Event:     EVENT_DIFFERENCE,
+		Reference: *pair.ref.root,
+		Backup:    *pair.bck.root,
+		Path:      relPath,
+		Kind:      diffKind(err),
+		Message:   err.Error(),
+	}
+	if diff, ok := err.(*Difference); ok {
+		e.Message = diff.msg
+		if diff.Reference != DIFF_NO_VALUE || diff.Backup != DIFF_NO_VALUE {
+			e.ReferenceValue = diff.Reference
+			e.BackupValue = diff.Backup
+		}
+		if diff.Offset >= 0 {
+			offset := diff.Offset
+			e.Offset = &offset
+		}
+	}
+	return e
+}
+
+// Reporter is given each Event of a run, and writes it out somewhere (ex,
+// as JSON lines, or a report once the run is done).
+type Reporter interface {
+	Report(e *Event)
+	Close() error
+}
+
+type Reporters []Reporter
+
+func (rs Reporters) Report(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, r := range rs {
+		r.Report(e)
+	}
+}
+
+// Close closes every reporter, returning the first error.
+func (rs Reporters) Close() error {
+	var res error
+	for _, r := range rs {
+		err := r.Close()
+		if err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// EventLog writes each Event as a line of JSON.
+type EventLog struct {
+	closer io.Closer
+	enc    *json.Encoder
+	lock   sync.Mutex
+}
+
+// OpenEventLog creates an EventLog which writes to name, or to stdout if
+// name is "-".
+func OpenEventLog(name string, stdout io.Writer) (*EventLog, error) {
+	if name == "-" {
+		return &EventLog{
+			enc: json.NewEncoder(stdout),
+		}, nil
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLog{
+		closer: f,
+		enc:    json.NewEncoder(f),
+	}, nil
+}
+
+func (l *EventLog) Report(e *Event) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.enc.Encode(e)
+	if err != nil {
+		logger.Errorf("Error writing event: %s", err)
+	}
+}
+
+func (l *EventLog) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
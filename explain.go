@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// markerIn returns the name of the marker file which excludes dir, or "" if
+// it doesn't contain one.
+func (e *Excluder) markerIn(dir *WalkerItem) string {
+	if e == nil {
+		return ""
+	}
+
+	names := make([]string, 0, len(e.markers))
+	for name := range e.markers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	markers := []*WalkerItem{}
+	for _, name := range names {
+		markerPath := path.Join(dir.path, name)
+		if _, err := os.Lstat(markerPath); err == nil {
+			markers = append(markers, WalkerItemFromFile(dir.root, markerPath, nil))
+		}
+	}
+	return e.markedBy(markers)
+}
+
+// explainSkip returns why relPath wouldn't be checked, or "" if it would be,
+// following the same rules as the walker: --include, excludes and marker
+// files for it and each of its parents, then the attribute filters.
+func explainSkip(pair Pair, excluder *Excluder, filter *AttrFilter, item *WalkerItem) string {
+	relPath := item.RelPath()
+	if len(pair.seeds) > 0 && !underAnyPath(relPath, pair.seeds) {
+		return "not under any --include or --files-from path"
+	}
+
+	if marker := excluder.markerIn(pair.ref); marker != "" {
+		return "the reference directory contains the marker file " + marker
+	}
+
+	parent := ""
+	bits := strings.Split(relPath, "/")
+	for idx := range bits {
+		if relPath == "" {
+			break
+		}
+		cur := strings.Join(bits[:idx+1], "/")
+		curItem := WalkerItemFromFile(pair.ref.root, path.Join(*pair.ref.root, cur), nil)
+		if reason := excluder.Match(excluder.scopeFor(pair.ref, parent), cur, curItem.IsDir()); reason != "" {
+			if cur == relPath {
+				return "excluded by " + reason
+			}
+			return fmt.Sprintf("%s is excluded by %s", cur, reason)
+		}
+		if curItem.IsDir() {
+			if marker := excluder.markerIn(curItem); marker != "" {
+				return fmt.Sprintf("%s contains the marker file %s", cur, marker)
+			}
+		}
+		parent = cur
+	}
+
+	if reason := filter.Skip(item); reason != "" {
+		return "filtered by " + reason
+	}
+
+	return ""
+}
+
+// explain writes whether each of paths would be checked and, if it would,
+// the result of checking it.
+func explain(out io.Writer, pair Pair, excluder *Excluder, filter *AttrFilter, paths []string) error {
+	relPaths, err := seedPaths(*pair.ref.root, paths)
+	if err != nil {
+		return err
+	}
+
+	for _, relPath := range relPaths {
+		refItem := WalkerItemFromFile(pair.ref.root, path.Join(*pair.ref.root, relPath), nil)
+		name := relPath
+		if name == "" {
+			name = "."
+		}
+		if err := refItem.Err(); err != nil {
+			fmt.Fprintf(out, "%s: %s\n", name, err)
+			continue
+		}
+
+		if reason := explainSkip(pair, excluder, filter, refItem); reason != "" {
+			fmt.Fprintf(out, "%s: not checked: %s\n", name, reason)
+			continue
+		}
+
+		bckItem := pair.bck.GetItem(refItem)
+		err := check(refItem, &bckItem, pair.cutoff)
+		if err == nil {
+			fmt.Fprintf(out, "%s: checked: ok\n", name)
+		} else {
+			fmt.Fprintf(out, "%s: checked: %s\n", name, err)
+		}
+	}
+	return nil
+}
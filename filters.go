@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var fileTypeLetters = map[string]os.FileMode{
+	"f": 0,
+	"d": os.ModeDir,
+	"l": os.ModeSymlink,
+	"p": os.ModeNamedPipe,
+	"s": os.ModeSocket,
+	"c": os.ModeDevice | os.ModeCharDevice,
+	"b": os.ModeDevice,
+}
+
+// AttrFilter skips reference items based on their size, age, type, or
+// extension. Only --type applies to directories; they're always walked.
+type AttrFilter struct {
+	MinSize        int64
+	MaxSize        int64
+	ModifiedWithin time.Duration
+	OlderThan      time.Duration
+
+	types map[os.FileMode]bool
+	exts  map[string]bool
+	now   time.Time
+}
+
+func NewAttrFilter(minSize ByteSize, maxSize ByteSize, modifiedWithin Age, olderThan Age, types string, exts []string) (*AttrFilter, error) {
+	f := &AttrFilter{
+		MinSize:        int64(minSize),
+		MaxSize:        int64(maxSize),
+		ModifiedWithin: time.Duration(modifiedWithin),
+		OlderThan:      time.Duration(olderThan),
+		now:            time.Now(),
+	}
+
+	if f.MaxSize > 0 && f.MinSize > f.MaxSize {
+		return nil, errors.New("--min-size is larger than --max-size")
+	}
+
+	if types != "" {
+		f.types = map[os.FileMode]bool{}
+		for _, t := range strings.Split(types, ",") {
+			mode, ok := fileTypeLetters[strings.TrimSpace(t)]
+			if !ok {
+				return nil, errors.New("invalid --type: " + t + " (expected f, d, l, p, s, c, or b)")
+			}
+			f.types[mode] = true
+		}
+	}
+
+	for _, extList := range exts {
+		for _, ext := range strings.Split(extList, ",") {
+			ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+			if ext == "" {
+				continue
+			}
+			if f.exts == nil {
+				f.exts = map[string]bool{}
+			}
+			f.exts[ext] = true
+		}
+	}
+
+	return f, nil
+}
+
+// Active is true if any of the filters are set.
+func (f *AttrFilter) Active() bool {
+	if f == nil {
+		return false
+	}
+	return f.MinSize > 0 || f.MaxSize > 0 || f.ModifiedWithin > 0 || f.OlderThan > 0 ||
+		len(f.types) > 0 || len(f.exts) > 0
+}
+
+// Skip returns the option which excludes item, or "" if it should be
+// checked.
+func (f *AttrFilter) Skip(item *WalkerItem) string {
+	if f == nil {
+		return ""
+	}
+
+	statPtr, err := item.Stat()
+	if err != nil {
+		return ""
+	}
+	stat := *statPtr
+
+	if f.types != nil && !f.types[stat.Mode()&os.ModeType] {
+		return "--type"
+	}
+
+	if stat.IsDir() {
+		return ""
+	}
+
+	if f.MinSize > 0 && stat.Size() < f.MinSize {
+		return "--min-size"
+	}
+
+	if f.MaxSize > 0 && stat.Size() > f.MaxSize {
+		return "--max-size"
+	}
+
+	age := f.now.Sub(stat.ModTime())
+	if f.ModifiedWithin > 0 && age > f.ModifiedWithin {
+		return "--modified-within"
+	}
+
+	if f.OlderThan > 0 && age < f.OlderThan {
+		return "--older-than"
+	}
+
+	if f.exts != nil {
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(stat.Name()), "."))
+		if !f.exts[ext] {
+			return "--ext"
+		}
+	}
+
+	return ""
+}
+
+// describeCounts formats counts like "12 by --ext, 3 by --min-size".
+func describeCounts(counts map[string]int, sep string) string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := make([]string, len(keys))
+	for idx, key := range keys {
+		res[idx] = FormatInt(counts[key]) + sep + key
+	}
+	return strings.Join(res, ", ")
+}
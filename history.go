@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// HISTORY_FILE_NAME is a JSON line for each pair checked, in the state
+// directory.
+const HISTORY_FILE_NAME = "history.jsonl"
+
+// HistoryRecord is the result of checking a pair, as saved in the history.
+type HistoryRecord struct {
+	PairResult
+	ExitStatus int    `json:"exit_status"`
+	Options    string `json:"options"`
+}
+
+// pair identifies the pair of a record: its reference directory, and its
+// backup directory (or the root of its snapshots, so runs of newer snapshots
+// are the same pair).
+func (r *HistoryRecord) pair() string {
+	bck := r.BackupKey
+	if bck == "" {
+		bck = r.Backup
+	}
+	return r.Reference + ":" + bck
+}
+
+func (r *HistoryRecord) rate() float64 {
+	seconds := r.Finished.Sub(r.Started).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / seconds
+}
+
+// optionsFingerprint hashes the options of a run, without its pairs, so runs
+// with different options can be told apart.
+func optionsFingerprint(options []string, pairs []string) string {
+	isPair := map[string]bool{}
+	for _, pair := range pairs {
+		isPair[pair] = true
+	}
+	hash := sha256.New()
+	for _, opt := range options {
+		if !isPair[opt] {
+			hash.Write([]byte(opt))
+			hash.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+func LoadHistory(stateDir string) ([]*HistoryRecord, error) {
+	f, err := os.Open(path.Join(stateDir, HISTORY_FILE_NAME))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := []*HistoryRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		record := &HistoryRecord{}
+		if json.Unmarshal(scanner.Bytes(), record) != nil {
+			// A partial line from a run which was killed
+			continue
+		}
+		res = append(res, record)
+	}
+	return res, scanner.Err()
+}
+
+// HistoryStore appends a HistoryRecord for each pair to the history, and
+// prunes records older than maxAge, or beyond the last maxRuns of each pair,
+// when the run is done (0 keeps them).
+type HistoryStore struct {
+	path    string
+	maxAge  time.Duration
+	maxRuns int
+	options string
+	added   bool
+}
+
+func NewHistoryStore(stateDir string, maxAge time.Duration, maxRuns int) *HistoryStore {
+	return &HistoryStore{
+		path:    path.Join(stateDir, HISTORY_FILE_NAME),
+		maxAge:  maxAge,
+		maxRuns: maxRuns,
+	}
+}
+
+func (h *HistoryStore) Report(e *Event) {
+	switch e.Event {
+	case EVENT_RUN_START:
+		h.options = optionsFingerprint(e.Options, e.Pairs)
+	case EVENT_PAIR_END:
+		if e.Summary == nil {
+			return
+		}
+		record := &HistoryRecord{PairResult: *e.Summary, Options: h.options}
+		if e.ExitStatus != nil {
+			record.ExitStatus = *e.ExitStatus
+		}
+		err := h.add(record)
+		if err != nil {
+			logger.Errorf("Error saving history: %s", err)
+		}
+	}
+}
+
+// lock waits for other runs to finish adding to or pruning the history, and
+// returns a function which unlocks it. The lock file is separate from the
+// history, which prune replaces.
+func (h *HistoryStore) lock() (func(), error) {
+	f, err := os.OpenFile(h.path+".lock", os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// add appends record in a single write, while holding the lock, so runs of
+// other pairs can add theirs at the same time.
+func (h *HistoryStore) add(record *HistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	unlock, err := h.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	h.added = true
+	return err
+}
+
+func (h *HistoryStore) Close() error {
+	if !h.added || (h.maxAge <= 0 && h.maxRuns <= 0) {
+		return nil
+	}
+	return h.prune()
+}
+
+// prune rewrites the history without the records which are too old, or
+// beyond the last maxRuns of their pair. It holds the lock until the new
+// history replaces the old one, so records added meanwhile aren't lost.
+func (h *HistoryStore) prune() error {
+	unlock, err := h.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	records, err := LoadHistory(path.Dir(h.path))
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-h.maxAge)
+	runs := map[string]int{}
+	keep := []*HistoryRecord{}
+	for idx := len(records) - 1; idx >= 0; idx -= 1 {
+		record := records[idx]
+		if h.maxAge > 0 && record.Finished.Before(cutoff) {
+			continue
+		}
+		runs[record.pair()] += 1
+		if h.maxRuns > 0 && runs[record.pair()] > h.maxRuns {
+			continue
+		}
+		keep = append(keep, record)
+	}
+	if len(keep) == len(records) {
+		return nil
+	}
+
+	tmpPath := h.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for idx := len(keep) - 1; idx >= 0 && err == nil; idx -= 1 {
+		err = enc.Encode(keep[idx])
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	logger.Debugf("Pruned %d runs from the history", len(records)-len(keep))
+	return os.Rename(tmpPath, h.path)
+}
+
+func formatRate(bytesPerSecond float64) string {
+	return fmt.Sprintf("%0.02fMB/s", bytesPerSecond/1024.0/1024.0)
+}
+
+func formatAge(now time.Time, t time.Time) string {
+	age := now.Sub(t)
+	if age >= 48*time.Hour {
+		return fmt.Sprintf("%d days ago", int(age.Hours()/24))
+	}
+	return age.Round(time.Minute).String() + " ago"
+}
+
+// showHistory shows the last limit runs of each pair (or of the pairs of
+// refs, if any are given), and how they're trending.
+func showHistory(out io.Writer, stateDir string, refs []string, limit int) error {
+	records, err := LoadHistory(stateDir)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+	for _, ref := range refs {
+		// Pairs work too, so commands can be copied and pasted
+		if idx := strings.Index(ref, ":"); idx > 0 {
+			ref = ref[:idx]
+		}
+		abs, err := filepath.Abs(ref)
+		if err != nil {
+			return err
+		}
+		wanted[abs] = true
+	}
+
+	byPair := map[string][]*HistoryRecord{}
+	names := []string{}
+	for _, record := range records {
+		if len(wanted) > 0 && !wanted[record.Reference] {
+			continue
+		}
+		if _, ok := byPair[record.pair()]; !ok {
+			names = append(names, record.pair())
+		}
+		byPair[record.pair()] = append(byPair[record.pair()], record)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := byPair[names[i]][0], byPair[names[j]][0]
+		if a.Reference != b.Reference {
+			return a.Reference < b.Reference
+		}
+		return names[i] < names[j]
+	})
+
+	if len(names) == 0 && len(records) > 0 {
+		fmt.Fprintf(out, "No history of those reference directories in %s\n", path.Join(stateDir, HISTORY_FILE_NAME))
+		return nil
+	}
+	if len(names) == 0 {
+		fmt.Fprintf(out, "No history in %s\n", path.Join(stateDir, HISTORY_FILE_NAME))
+		return nil
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		all := byPair[name]
+		shown := all
+		if limit > 0 && len(shown) > limit {
+			shown = shown[len(shown)-limit:]
+		}
+		last := all[len(all)-1]
+
+		fmt.Fprintf(out, "%s:\n", last.Reference)
+		fmt.Fprintf(out, "  Backup: %s\n", last.Backup)
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "  Started\tTook\tChecked\tBytes\tRate\tDifferences\tExit\tOptions\n")
+		for _, r := range shown {
+			fmt.Fprintf(w, "  %s\t%v\t%s\t%s\t%s\t%s\t%d\t%s\n",
+				r.Started.Local().Format("2006-01-02 15:04:05"),
+				r.Finished.Sub(r.Started).Round(time.Second),
+				FormatInt(r.Checked),
+				FormatInt(int64(r.Bytes)),
+				formatRate(r.rate()),
+				FormatInt(r.Errors),
+				r.ExitStatus,
+				r.Options,
+			)
+		}
+		w.Flush()
+
+		total := 0.0
+		for _, r := range all {
+			total += r.rate()
+		}
+		fmt.Fprintf(out, "  Runs: %s since %s\n", FormatInt(len(all)), all[0].Started.Local().Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(out, "  Throughput: %s average, %s last run\n", formatRate(total/float64(len(all))), formatRate(last.rate()))
+
+		first := shown[0]
+		change := last.Errors - first.Errors
+		fmt.Fprintf(out, "  Differences: %s -> %s (%+d over %s runs)", FormatInt(first.Errors), FormatInt(last.Errors), change, FormatInt(len(shown)))
+		if len(last.Diffs) > 0 {
+			fmt.Fprintf(out, "; last run: %s", describeCounts(last.Diffs, " "))
+		}
+		fmt.Fprintf(out, "\n")
+
+		var lastClean *HistoryRecord
+		for idx := len(all) - 1; idx >= 0; idx -= 1 {
+			if all[idx].ExitStatus == 0 {
+				lastClean = all[idx]
+				break
+			}
+		}
+		if lastClean == nil {
+			fmt.Fprintf(out, "  Last clean run: never (in the history)\n")
+		} else {
+			fmt.Fprintf(out, "  Last clean run: %s (%s)\n",
+				lastClean.Finished.Local().Format("2006-01-02 15:04:05"),
+				formatAge(now, lastClean.Finished),
+			)
+		}
+	}
+
+	return nil
+}
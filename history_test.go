@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func historyRecord(ref string, bck string, finished time.Time, checked int) *HistoryRecord {
+	return &HistoryRecord{PairResult: PairResult{
+		Reference: ref,
+		Backup:    bck,
+		BackupKey: bck,
+		Started:   finished.Add(-time.Minute),
+		Finished:  finished,
+		Checked:   checked,
+	}}
+}
+
+func writeHistory(t *testing.T, stateDir string, records ...*HistoryRecord) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, path.Join(stateDir, HISTORY_FILE_NAME), buf.String())
+}
+
+// historyChecked returns the pair and Checked count of each record in the
+// history, which the tests use to tell records apart.
+func historyChecked(t *testing.T, stateDir string) []string {
+	records, err := LoadHistory(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := []string{}
+	for _, record := range records {
+		res = append(res, record.pair()+"="+FormatInt(record.Checked))
+	}
+	return res
+}
+
+func TestHistoryPruneRuns(t *testing.T) {
+	stateDir := t.TempDir()
+	now := time.Now()
+	writeHistory(t, stateDir,
+		historyRecord("/a", "/b1", now, 1),
+		historyRecord("/a", "/b2", now, 2),
+		historyRecord("/a", "/b1", now, 3),
+		historyRecord("/a", "/b1", now, 4),
+		historyRecord("/c", "/b1", now, 5),
+		historyRecord("/a", "/b2", now, 6),
+		historyRecord("/a", "/b1", now, 7),
+	)
+
+	h := NewHistoryStore(stateDir, 0, 2)
+	err := h.prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last 2 runs of each pair are kept, in order
+	expected := "/a:/b2=2 /a:/b1=4 /c:/b1=5 /a:/b2=6 /a:/b1=7"
+	if res := strings.Join(historyChecked(t, stateDir), " "); res != expected {
+		t.Errorf("got %s, expected %s", res, expected)
+	}
+}
+
+func TestHistoryPruneAge(t *testing.T) {
+	stateDir := t.TempDir()
+	now := time.Now()
+	old := historyRecord("/a", "/b", now.Add(-48*time.Hour), 1)
+	// Records without a backup key are from before it was saved
+	old.BackupKey = ""
+	writeHistory(t, stateDir,
+		old,
+		historyRecord("/a", "/b", now.Add(-time.Hour), 2),
+		historyRecord("/a", "/b", now, 3),
+	)
+
+	h := NewHistoryStore(stateDir, 24*time.Hour, 0)
+	err := h.prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "/a:/b=2 /a:/b=3"
+	if res := strings.Join(historyChecked(t, stateDir), " "); res != expected {
+		t.Errorf("got %s, expected %s", res, expected)
+	}
+	if _, err := os.Stat(path.Join(stateDir, HISTORY_FILE_NAME+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("the history's temporary file was left behind")
+	}
+
+	// Nothing is pruned if nothing was added
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistoryPruneWaitsForAdd(t *testing.T) {
+	stateDir := t.TempDir()
+	now := time.Now()
+	writeHistory(t, stateDir,
+		historyRecord("/a", "/b", now, 1),
+		historyRecord("/a", "/b", now, 2),
+	)
+	h := NewHistoryStore(stateDir, 0, 1)
+
+	// Another run is adding a record
+	unlock, err := h.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.prune()
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("prune didn't wait for the lock (%v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	f, err := os.OpenFile(path.Join(stateDir, HISTORY_FILE_NAME), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewEncoder(f).Encode(historyRecord("/a", "/b2", now, 3))
+	f.Close()
+	unlock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	expected := "/a:/b=2 /a:/b2=3"
+	if res := strings.Join(historyChecked(t, stateDir), " "); res != expected {
+		t.Errorf("got %s, expected %s", res, expected)
+	}
+}
+
+func TestShowHistoryByPair(t *testing.T) {
+	stateDir := t.TempDir()
+	now := time.Now()
+	// Runs of newer snapshots are runs of the same pair
+	snapshot1 := historyRecord("/a", "/pool/.zfs/snapshot/s1", now, 3)
+	snapshot1.BackupKey = "/pool"
+	snapshot2 := historyRecord("/a", "/pool/.zfs/snapshot/s2", now, 4)
+	snapshot2.BackupKey = "/pool"
+	writeHistory(t, stateDir,
+		historyRecord("/a", "/b2", now, 1),
+		historyRecord("/a", "/b1", now, 2),
+		snapshot1,
+		snapshot2,
+	)
+
+	var out bytes.Buffer
+	err := showHistory(&out, stateDir, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups := []string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "  Backup: ") {
+			backups = append(backups, strings.TrimPrefix(line, "  Backup: "))
+		}
+	}
+	expected := "/b1 /b2 /pool/.zfs/snapshot/s2"
+	if res := strings.Join(backups, " "); res != expected {
+		t.Errorf("got backups %s, expected %s:\n%s", res, expected, out.String())
+	}
+	if !strings.Contains(out.String(), "Runs: 2 since") {
+		t.Errorf("expected the runs of both snapshots together:\n%s", out.String())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hooks are shell commands run when a pair finishes. They're given the
+// result of the pair in BACKUP_CHK_* environment variables.
+type Hooks struct {
+	OnSuccess    string
+	OnFailure    string
+	OnDifference string
+
+	// The pair being checked, until it finishes
+	current *PairResult
+}
+
+func hookEnv(result *PairResult, exitStatus int, logPath string) []string {
+	kinds := make([]string, 0, len(result.Diffs))
+	for kind := range result.Diffs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	diffs := make([]string, len(kinds))
+	for idx, kind := range kinds {
+		diffs[idx] = fmt.Sprintf("%s=%d", kind, result.Diffs[kind])
+	}
+
+	return []string{
+		"BACKUP_CHK_REFERENCE=" + result.Reference,
+		"BACKUP_CHK_BACKUP=" + result.Backup,
+		"BACKUP_CHK_RESULT=" + result.Result,
+		fmt.Sprintf("BACKUP_CHK_EXIT_STATUS=%d", exitStatus),
+		fmt.Sprintf("BACKUP_CHK_CHECKED=%d", result.Checked),
+		fmt.Sprintf("BACKUP_CHK_DIFFERENCES=%d", result.Errors),
+		"BACKUP_CHK_DIFFERENCE_KINDS=" + strings.Join(diffs, " "),
+		fmt.Sprintf("BACKUP_CHK_CHANGED=%d", result.Changed),
+		fmt.Sprintf("BACKUP_CHK_FILTERED=%d", result.Filtered),
+		fmt.Sprintf("BACKUP_CHK_PENDING=%d", result.Pending),
+		fmt.Sprintf("BACKUP_CHK_BYTES=%d", result.Bytes),
+		"BACKUP_CHK_LOG=" + logPath,
+	}
+}
+
+// runHook runs cmd with sh. Its output goes to stderr, so it can't get mixed
+// up with --output json.
+func runHook(name string, cmd string, env []string) {
+	if cmd == "" {
+		return
+	}
+	logger.Infof("Running --%s: %s", name, cmd)
+	proc := exec.Command("/bin/sh", "-c", cmd)
+	proc.Env = append(os.Environ(), env...)
+	proc.Env = append(proc.Env, "BACKUP_CHK_HOOK="+name)
+	proc.Stdout = os.Stderr
+	proc.Stderr = os.Stderr
+	err := proc.Run()
+	if err != nil {
+		logger.Errorf("Error running --%s %q: %s", name, cmd, err)
+	}
+}
+
+// PairStarted records the pair being checked, so Close can run --on-failure
+// if a fatal error stops the run before the pair finishes.
+func (h *Hooks) PairStarted(reference string, backup string) {
+	h.current = &PairResult{
+		Reference: reference,
+		Backup:    backup,
+		Started:   time.Now(),
+	}
+}
+
+// PairFinished runs the hooks for a pair which finished (or stopped early)
+// with exitStatus: --on-difference if any differences were found, then
+// --on-success or --on-failure.
+func (h *Hooks) PairFinished(result *PairResult, exitStatus int, logPath string) {
+	h.current = nil
+	env := hookEnv(result, exitStatus, logPath)
+	if result.Errors > 0 {
+		runHook("on-difference", h.OnDifference, env)
+	}
+	if exitStatus == 0 {
+		runHook("on-success", h.OnSuccess, env)
+	} else {
+		runHook("on-failure", h.OnFailure, env)
+	}
+}
+
+// Close runs --on-failure with exit status 1 if a pair was started but never
+// finished, because a fatal error stopped the run.
+func (h *Hooks) Close() {
+	if h.current == nil {
+		return
+	}
+	result := h.current
+	h.current = nil
+	result.Finished = time.Now()
+	result.Result = "failed"
+	runHook("on-failure", h.OnFailure, hookEnv(result, 1, ""))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HTML_MAX_DIFFS limits the differences listed for each pair, so a badly
+// broken backup doesn't make a report too big to open. They're all counted.
+const HTML_MAX_DIFFS = 10000
+
+type htmlDiffNode struct {
+	Name  string
+	Count int
+	Dirs  []*htmlDiffNode
+	Diffs []*Event
+
+	dirs map[string]*htmlDiffNode
+}
+
+func (n *htmlDiffNode) add(dirs []string, e *Event) {
+	n.Count += 1
+	if len(dirs) == 0 {
+		n.Diffs = append(n.Diffs, e)
+		return
+	}
+
+	child, ok := n.dirs[dirs[0]]
+	if !ok {
+		child = &htmlDiffNode{Name: dirs[0], dirs: map[string]*htmlDiffNode{}}
+		n.dirs[dirs[0]] = child
+		n.Dirs = append(n.Dirs, child)
+	}
+	child.add(dirs[1:], e)
+}
+
+func (n *htmlDiffNode) sort() {
+	sort.Slice(n.Dirs, func(i, j int) bool { return n.Dirs[i].Name < n.Dirs[j].Name })
+	sort.Slice(n.Diffs, func(i, j int) bool { return n.Diffs[i].Path < n.Diffs[j].Path })
+	for _, dir := range n.Dirs {
+		dir.sort()
+	}
+}
+
+type htmlKindGroup struct {
+	Kind  string
+	Count int
+	Tree  *htmlDiffNode
+}
+
+type htmlFolderTotal struct {
+	Folder string
+	Count  int
+	Kinds  map[string]int
+}
+
+type htmlPair struct {
+	Reference string
+	Backup    string
+	Summary   *PairResult
+	Kinds     []*htmlKindGroup
+	Folders   []*htmlFolderTotal
+	Omitted   int
+
+	kinds   map[string]*htmlKindGroup
+	folders map[string]*htmlFolderTotal
+	listed  int
+}
+
+func (p *htmlPair) addDifference(e *Event) {
+	folder := "."
+	bits := strings.Split(e.Path, "/")
+	if len(bits) > 1 {
+		folder = bits[0]
+	}
+	total, ok := p.folders[folder]
+	if !ok {
+		total = &htmlFolderTotal{Folder: folder, Kinds: map[string]int{}}
+		p.folders[folder] = total
+		p.Folders = append(p.Folders, total)
+	}
+	total.Count += 1
+	total.Kinds[e.Kind] += 1
+
+	if p.listed >= HTML_MAX_DIFFS {
+		p.Omitted += 1
+		return
+	}
+	p.listed += 1
+
+	group, ok := p.kinds[e.Kind]
+	if !ok {
+		group = &htmlKindGroup{
+			Kind: e.Kind,
+			Tree: &htmlDiffNode{dirs: map[string]*htmlDiffNode{}},
+		}
+		p.kinds[e.Kind] = group
+		p.Kinds = append(p.Kinds, group)
+	}
+	group.Count += 1
+	group.Tree.add(bits[:len(bits)-1], e)
+}
+
+// HTMLReport writes a self-contained HTML page summarizing the run, with the
+// differences of each pair as a collapsible directory tree.
+type HTMLReport struct {
+	path     string
+	excludes []string
+	start    *Event
+	end      *Event
+	pairs    []*htmlPair
+	pair     *htmlPair
+}
+
+func NewHTMLReport(path string, excludes []string) *HTMLReport {
+	return &HTMLReport{
+		path:     path,
+		excludes: excludes,
+	}
+}
+
+func (r *HTMLReport) Report(e *Event) {
+	switch e.Event {
+	case EVENT_RUN_START:
+		r.start = e
+	case EVENT_PAIR_START:
+		r.pair = &htmlPair{
+			Reference: e.Reference,
+			Backup:    e.Backup,
+			kinds:     map[string]*htmlKindGroup{},
+			folders:   map[string]*htmlFolderTotal{},
+		}
+		r.pairs = append(r.pairs, r.pair)
+	case EVENT_DIFFERENCE:
+		if r.pair != nil {
+			r.pair.addDifference(e)
+		}
+	case EVENT_PAIR_END:
+		if r.pair != nil {
+			r.pair.Summary = e.Summary
+		}
+	case EVENT_RUN_END:
+		r.end = e
+	}
+}
+
+func htmlRate(s *PairResult) string {
+	if s == nil {
+		return ""
+	}
+	seconds := s.Finished.Sub(s.Started).Seconds()
+	if seconds <= 0 {
+		return "-"
+	}
+	return FormatInt(int64(float64(s.Bytes)/seconds)) + " bytes/s"
+}
+
+var htmlReportFuncs = template.FuncMap{
+	"int": func(n interface{}) string {
+		if u, ok := n.(uint64); ok {
+			n = int64(u)
+		}
+		return FormatInt(n)
+	},
+	"counts": func(counts map[string]int) string {
+		return describeCounts(counts, " ")
+	},
+	"time": func(t time.Time) string {
+		return t.Local().Format("2006-01-02 15:04:05")
+	},
+	"duration": func(s *PairResult) time.Duration {
+		return s.Finished.Sub(s.Started).Round(time.Millisecond)
+	},
+	"rate": htmlRate,
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(htmlReportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>backup-chk report{{ if .End }}: {{ time .End.Time }}{{ end }}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.2em; margin-top: 2em; border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; margin: 0.5em 0; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+td.num { text-align: right; }
+code, .path { font-family: Menlo, Consolas, monospace; font-size: 0.9em; }
+details { margin-left: 1.2em; }
+details.kind { margin-left: 0; }
+summary { cursor: pointer; }
+ul.diffs { margin: 0.2em 0 0.2em 1.2em; padding: 0; list-style: none; }
+.ok { color: #2a7a2a; }
+.bad { color: #b02a2a; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>backup-chk report</h1>
+<table>
+{{ with .End }}{{ with .Summary }}
+<tr><th>Started</th><td>{{ time .Started }}</td></tr>
+<tr><th>Finished</th><td>{{ time .Finished }} ({{ duration . }}, {{ rate . }})</td></tr>
+<tr><th>Result</th><td>{{ .Result }}: {{ int .Checked }} checked, {{ int .Errors }} differences, {{ int .Changed }} changed since backup, {{ int .Filtered }} filtered, {{ int .Bytes }} bytes</td></tr>
+{{ end }}<tr><th>Exit status</th><td>{{ if .ExitStatus }}{{ .ExitStatus }}{{ end }}</td></tr>{{ end }}
+{{ with .Start }}<tr><th>Options</th><td><code>{{ range .Options }}{{ . }} {{ end }}</code></td></tr>{{ end }}
+<tr><th>Excludes</th><td>{{ range .Excludes }}<code>{{ . }}</code><br>{{ else }}<span class="muted">none</span>{{ end }}</td></tr>
+</table>
+
+{{ range .Pairs }}
+<h2><span class="path">{{ .Reference }}</span> &rarr; <span class="path">{{ .Backup }}</span></h2>
+{{ with .Summary }}
+<p class="{{ if .Errors }}bad{{ else }}ok{{ end }}">
+{{ .Result }}: {{ int .Checked }} checked, {{ int .Errors }} differences{{ if .Diffs }} ({{ counts .Diffs }}){{ end }}, {{ int .Changed }} changed since backup, {{ int .Filtered }} filtered, {{ int .Bytes }} bytes in {{ duration . }} ({{ rate . }}){{ if .Pending }}; {{ int .Pending }} items left for the next run{{ end }}
+</p>
+{{ else }}
+<p class="bad">Didn't finish.</p>
+{{ end }}
+{{ if .Folders }}
+<table>
+<tr><th>Top-level folder</th><th>Differences</th><th></th></tr>
+{{ range .Folders }}<tr><td class="path">{{ .Folder }}</td><td class="num">{{ int .Count }}</td><td class="muted">{{ counts .Kinds }}</td></tr>
+{{ end }}</table>
+{{ range .Kinds }}
+<details class="kind" open><summary><b>{{ .Kind }}</b> ({{ int .Count }})</summary>
+{{ template "tree" .Tree }}
+</details>
+{{ end }}
+{{ if .Omitted }}<p class="muted">{{ int .Omitted }} more differences aren't listed.</p>{{ end }}
+{{ end }}
+{{ end }}
+</body>
+</html>
+{{ define "tree" }}{{ range .Dirs }}<details><summary class="path">{{ .Name }}/ <span class="muted">({{ int .Count }})</span></summary>
+{{ template "tree" . }}</details>
+{{ end }}{{ if .Diffs }}<ul class="diffs">{{ range .Diffs }}<li><span class="path">{{ .Path }}</span>: {{ .Message }}{{ if or .ReferenceValue .BackupValue }} <span class="muted">(reference {{ .ReferenceValue }}, backup {{ .BackupValue }})</span>{{ end }}</li>
+{{ end }}</ul>{{ end }}{{ end }}
+`))
+
+// Close writes the report.
+func (r *HTMLReport) Close() error {
+	for _, pair := range r.pairs {
+		sort.Slice(pair.Kinds, func(i, j int) bool { return pair.Kinds[i].Kind < pair.Kinds[j].Kind })
+		sort.Slice(pair.Folders, func(i, j int) bool {
+			a, b := pair.Folders[i], pair.Folders[j]
+			return a.Count > b.Count || (a.Count == b.Count && a.Folder < b.Folder)
+		})
+		for _, group := range pair.Kinds {
+			group.Tree.sort()
+		}
+	}
+
+	tmpPath := r.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = htmlReportTemplate.Execute(f, map[string]interface{}{
+		"Start":    r.start,
+		"End":      r.end,
+		"Excludes": r.excludes,
+		"Pairs":    r.pairs,
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, r.path)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const IGNORE_FILE_NAME = ".backupchkignore"
+
+type ignoreRule struct {
+	pattern string
+	source  string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+func (r *ignoreRule) String() string {
+	return fmt.Sprintf("%s (%s)", r.pattern, r.source)
+}
+
+// IgnoreRules is a list of gitignore-style rules which apply to the paths
+// under base (a path relative to the pair root; "" for the root itself).
+type IgnoreRules struct {
+	base  string
+	rules []*ignoreRule
+}
+
+// ParseIgnoreRules parses gitignore-style rules: blank lines and lines
+// starting with '#' are ignored, '*', '?', '[...]' and '**' are globs, a
+// leading '!' re-includes paths excluded by an earlier rule, a trailing '/'
+// only matches directories, and patterns containing a '/' (other than at the
+// end) are anchored to base.
+func ParseIgnoreRules(r io.Reader, source string, base string) (*IgnoreRules, error) {
+	res := &IgnoreRules{base: base}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum += 1
+		line := scanner.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		rule := &ignoreRule{
+			pattern: line,
+			source:  fmt.Sprintf("%s:%d", source, lineNum),
+		}
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		re, err := compileIgnorePattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %q: %s", rule.source, rule.pattern, err)
+		}
+		rule.re = re
+		res.rules = append(res.rules, rule)
+	}
+
+	return res, scanner.Err()
+}
+
+func LoadIgnoreFile(filePath string, base string) (*IgnoreRules, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseIgnoreRules(f, filePath, base)
+}
+
+func compileIgnorePattern(pat string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(pat, "/")
+	pat = strings.TrimPrefix(pat, "/")
+
+	var re bytes.Buffer
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(pat); {
+		atSegmentStart := i == 0 || pat[i-1] == '/'
+		switch {
+		case atSegmentStart && strings.HasPrefix(pat[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 3
+		case atSegmentStart && pat[i:] == "**":
+			re.WriteString(".*")
+			i += 2
+		case pat[i] == '*':
+			re.WriteString("[^/]*")
+			i += 1
+		case pat[i] == '?':
+			re.WriteString("[^/]")
+			i += 1
+		case pat[i] == '[':
+			class, n := translateCharClass(pat[i:])
+			if n == 0 {
+				re.WriteString(`\[`)
+				i += 1
+			} else {
+				re.WriteString(class)
+				i += n
+			}
+		case pat[i] == '\\' && i+1 < len(pat):
+			re.WriteString(regexp.QuoteMeta(pat[i+1 : i+2]))
+			i += 2
+		default:
+			re.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+			i += 1
+		}
+	}
+
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// translateCharClass converts a glob character class at the start of pat to
+// a regular expression, returning the number of bytes of pat it used, or 0
+// if pat doesn't start with a complete class.
+func translateCharClass(pat string) (string, int) {
+	var res bytes.Buffer
+	res.WriteString("[")
+	i := 1
+	if i < len(pat) && (pat[i] == '!' || pat[i] == '^') {
+		res.WriteString("^/")
+		i += 1
+	}
+	first := true
+	for ; i < len(pat); i++ {
+		c := pat[i]
+		if c == ']' && !first {
+			res.WriteString("]")
+			return res.String(), i + 1
+		}
+		first = false
+		switch c {
+		case '\\':
+			if i+1 < len(pat) {
+				i += 1
+				res.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+			}
+		case '[', ']', '^':
+			res.WriteString(`\`)
+			res.WriteByte(c)
+		case '/':
+			return "", 0
+		default:
+			res.WriteByte(c)
+		}
+	}
+	return "", 0
+}
+
+// match returns the last rule which matches relPath, or nil.
+func (r *IgnoreRules) match(relPath string, isDir bool) *ignoreRule {
+	if r == nil {
+		return nil
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(relPath, r.base+"/") {
+			return nil
+		}
+		relPath = relPath[len(r.base)+1:]
+	}
+
+	var res *ignoreRule
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(relPath) {
+			res = rule
+		}
+	}
+	return res
+}
+
+// ignoreScope is the chain of rules which apply inside a directory: the
+// global rules, then each parent directory's ignore file, outermost first.
+// Scopes are never modified after they're created, so they can be shared.
+type ignoreScope struct {
+	parent *ignoreScope
+	rules  *IgnoreRules
+}
+
+func (s *ignoreScope) match(relPath string, isDir bool) *ignoreRule {
+	if s == nil {
+		return nil
+	}
+	if rule := s.rules.match(relPath, isDir); rule != nil {
+		return rule
+	}
+	return s.parent.match(relPath, isDir)
+}
+
+// Excluder decides which paths the walker skips. It combines the simple
+// --exclude globs, the Time Machine exclusions and --exclude-from rules, and
+// the per-directory ignore files found while walking.
+type Excluder struct {
+	globs    []*regexp.Regexp
+	rawGlobs []string
+	root     *ignoreScope
+	markers  map[string]bool
+}
+
+// NewExcluder returns an Excluder for globs, then rules, then the rules in the
+// excludeFrom files (so later rules can re-include paths).
+func NewExcluder(globs []string, rules []*IgnoreRules, excludeFrom []string, markers []string) (*Excluder, error) {
+	e := &Excluder{
+		rawGlobs: globs,
+		root:     &ignoreScope{},
+		markers:  map[string]bool{},
+	}
+	for _, marker := range markers {
+		if marker != "" {
+			e.markers[marker] = true
+		}
+	}
+	for _, glob := range globs {
+		bits := strings.Split(strings.Trim(glob, "*"), "*")
+		for idx, bit := range bits {
+			bits[idx] = regexp.QuoteMeta(bit)
+		}
+		re, err := regexp.Compile(strings.Join(bits, ".*"))
+		if err != nil {
+			return nil, err
+		}
+		e.globs = append(e.globs, re)
+	}
+
+	for _, filePath := range excludeFrom {
+		fileRules, err := LoadIgnoreFile(filePath, "")
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules)
+	}
+	for _, r := range rules {
+		e.root = &ignoreScope{parent: e.root, rules: r}
+	}
+
+	return e, nil
+}
+
+// Match returns a description of what excludes relPath, or "" if it isn't
+// excluded. scope is the ignoreScope of relPath's parent directory.
+func (e *Excluder) Match(scope *ignoreScope, relPath string, isDir bool) string {
+	if e == nil {
+		return ""
+	}
+
+	for idx, glob := range e.globs {
+		if glob.MatchString(relPath) {
+			return "--exclude " + e.rawGlobs[idx]
+		}
+	}
+
+	if scope == nil {
+		scope = e.root
+	}
+	rule := scope.match(relPath, isDir)
+	if rule != nil && !rule.negate {
+		return rule.String()
+	}
+	return ""
+}
+
+// childScope returns the scope for the contents of dir, loading its ignore
+// file if it has one.
+func (e *Excluder) childScope(scope *ignoreScope, dir *WalkerItem, hasIgnoreFile bool) *ignoreScope {
+	if e == nil {
+		return nil
+	}
+	if scope == nil {
+		scope = e.root
+	}
+	if !hasIgnoreFile {
+		return scope
+	}
+
+	rules, err := LoadIgnoreFile(path.Join(dir.path, IGNORE_FILE_NAME), dir.RelPath())
+	if err != nil {
+		logger.Errorf("Error loading ignore file (it will be ignored): %s", err)
+		return scope
+	}
+	return &ignoreScope{parent: scope, rules: rules}
+}
+
+// scopeFor rebuilds the scope for the contents of relDir by loading the
+// ignore files of it and its parents. It's used when resuming a walk, where
+// the scopes built while walking down to relDir aren't available.
+func (e *Excluder) scopeFor(root *WalkerItem, relDir string) *ignoreScope {
+	if e == nil {
+		return nil
+	}
+
+	scope := e.root
+	dirs := []string{""}
+	if relDir != "" {
+		bits := strings.Split(relDir, "/")
+		for idx := range bits {
+			dirs = append(dirs, strings.Join(bits[:idx+1], "/"))
+		}
+	}
+
+	for _, dir := range dirs {
+		dirItem := WalkerItemFromFile(root.root, path.Join(root.path, dir), nil)
+		_, err := os.Lstat(path.Join(dirItem.path, IGNORE_FILE_NAME))
+		scope = e.childScope(scope, dirItem, err == nil)
+	}
+	return scope
+}
+
+const CACHEDIR_TAG = "CACHEDIR.TAG"
+const CACHEDIR_TAG_SIGNATURE = "Signature: 8a477f597d28d172789f06886806bc55"
+
+func (e *Excluder) isMarker(name string) bool {
+	return e != nil && e.markers[name]
+}
+
+// markedBy returns the name of the marker file which excludes the directory
+// containing files, or "" if none of them do. See
+// https://bford.info/cachedir/ for the CACHEDIR.TAG format.
+func (e *Excluder) markedBy(files []*WalkerItem) string {
+	for _, f := range files {
+		name := path.Base(f.path)
+		if name != CACHEDIR_TAG {
+			return name
+		}
+
+		tag, err := os.Open(f.path)
+		if err != nil {
+			continue
+		}
+		buf := make([]byte, len(CACHEDIR_TAG_SIGNATURE))
+		_, err = io.ReadFull(tag, buf)
+		tag.Close()
+		if err == nil && string(buf) == CACHEDIR_TAG_SIGNATURE {
+			return name
+		}
+		logger.Infof("%s: ignoring CACHEDIR.TAG without a valid signature", f.RelPath())
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		relPath  string
+		isDir    bool
+		excluded bool
+	}{
+		{"*.log", "a.log", false, true},
+		{"*.log", "dir/a.log", false, true},
+		{"*.log", "a.logx", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.txt", "doc/a.txt", false, true},
+		{"doc/*.txt", "doc/sub/a.txt", false, false},
+		{"doc/*.txt", "x/doc/a.txt", false, false},
+		{"**/foo", "foo", false, true},
+		{"**/foo", "a/b/foo", false, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "xa/b", false, false},
+		{"logs/**", "logs/a/b", false, true},
+		{"logs/**", "logs", true, false},
+		{"fo?", "foo", false, true},
+		{"fo?", "fo/", false, false},
+		{"[!a]bc", "xbc", false, true},
+		{"[!a]bc", "abc", false, false},
+		{"[^a]bc", "abc", false, false},
+		{"x[!a]y", "x/y", false, false},
+		{"[a-c]?", "b1", false, true},
+		{"[a-c]?", "d1", false, false},
+		{"[]]", "]", false, true},
+		{"[", "[", false, true},
+		{`\*`, "*", false, true},
+		{`\*`, "a", false, false},
+		{`\!important`, "!important", false, true},
+		{`\#file`, "#file", false, true},
+		{`foo\ `, "foo ", false, true},
+		{"trailing  ", "trailing", false, true},
+		{"a.b", "axb", false, false},
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+		{"# comment", "# comment", false, false},
+	}
+	for _, test := range tests {
+		rules, err := ParseIgnoreRules(strings.NewReader(test.pattern), "test", "")
+		if err != nil {
+			t.Errorf("%q: %s", test.pattern, err)
+			continue
+		}
+		excluded := rules.match(test.relPath, test.isDir) != nil
+		if excluded != test.excluded {
+			t.Errorf("%q matching %q (isDir=%v): got %v, expected %v",
+				test.pattern, test.relPath, test.isDir, excluded, test.excluded)
+		}
+	}
+}
+
+func TestIgnoreRulesNegation(t *testing.T) {
+	rules, err := ParseIgnoreRules(strings.NewReader("*.log\n!keep.log\n"), "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := rules.match("a.log", false); rule == nil || rule.negate {
+		t.Errorf("a.log: got %v, expected *.log", rule)
+	}
+	if rule := rules.match("keep.log", false); rule == nil || !rule.negate {
+		t.Errorf("keep.log: got %v, expected !keep.log", rule)
+	}
+}
+
+func TestIgnoreRulesBase(t *testing.T) {
+	rules, err := ParseIgnoreRules(strings.NewReader("/tmp\n"), "test", "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relPath, expected := range map[string]bool{
+		"a/b/tmp":   true,
+		"a/b/c/tmp": false,
+		"tmp":       false,
+		"a/bx/tmp":  false,
+	} {
+		if excluded := rules.match(relPath, false) != nil; excluded != expected {
+			t.Errorf("%s: got %v, expected %v", relPath, excluded, expected)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, filePath string, data string) {
+	err := os.MkdirAll(path.Dir(filePath), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filePath, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExcluderNestedIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	excludeFrom := path.Join(dir, "exclude")
+	writeTestFile(t, excludeFrom, "*.log\n")
+	root := path.Join(dir, "root")
+	writeTestFile(t, path.Join(root, IGNORE_FILE_NAME), "*.tmp\n")
+	writeTestFile(t, path.Join(root, "keep", IGNORE_FILE_NAME), "!*.log\nsecret\n")
+	writeTestFile(t, path.Join(root, "keep", "sub", "a.log"), "")
+	writeTestFile(t, path.Join(root, "other", "a.log"), "")
+
+	e, err := NewExcluder([]string{"*.bak"}, nil, []string{excludeFrom}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootItem, err := WalkerItemFromRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logRule := "*.log (" + excludeFrom + ":1)"
+	tmpRule := "*.tmp (" + path.Join(root, IGNORE_FILE_NAME) + ":1)"
+	secretRule := "secret (" + path.Join(root, "keep", IGNORE_FILE_NAME) + ":2)"
+	tests := []struct {
+		dir      string
+		relPath  string
+		excluded string
+	}{
+		{"", "a.log", logRule},
+		{"", "a.tmp", tmpRule},
+		{"", "a.bak", "--exclude *.bak"},
+		{"", "a.txt", ""},
+		{"other", "other/a.log", logRule},
+		{"keep", "keep/a.log", ""},
+		{"keep", "keep/a.tmp", tmpRule},
+		{"keep", "keep/secret", secretRule},
+		{"keep/sub", "keep/sub/a.log", ""},
+		{"keep/sub", "keep/sub/secret", secretRule},
+		{"keep/sub", "keep/sub/a.bak", "--exclude *.bak"},
+	}
+	for _, test := range tests {
+		// scopeFor is how a resumed walk finds the rules of a directory
+		scope := e.scopeFor(rootItem, test.dir)
+		match := e.Match(scope, test.relPath, false)
+		if match != test.excluded {
+			t.Errorf("%s: got %q, expected %q", test.relPath, match, test.excluded)
+		}
+	}
+}
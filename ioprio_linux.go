@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioWhoProcess = 1
+)
+
+// setIOClass sets the I/O scheduling class of every thread in the process.
+// Threads started later inherit it from the thread which creates them.
+func setIOClass(class string) error {
+	var prio uintptr
+	switch class {
+	case "idle":
+		prio = ioprioClassIdle << ioprioClassShift
+	case "low":
+		prio = ioprioClassBE<<ioprioClassShift | 7
+	case "normal":
+		prio = ioprioClassBE<<ioprioClassShift | 4
+	default:
+		return errors.New("unknown I/O class: " + class + " (expected idle, low, or normal)")
+	}
+
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.Syscall(
+			syscall.SYS_IOPRIO_SET,
+			ioprioWhoProcess,
+			uintptr(tid),
+			prio,
+		)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func setIOClass(class string) error {
+	return errors.New("setting the I/O class is only supported on Linux")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name          `xml:"testsuites"`
+	Name     string            `xml:"name,attr"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Errors   int               `xml:"errors,attr"`
+	Time     string            `xml:"time,attr"`
+	Suites   []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Errors     int              `xml:"errors,attr"`
+	Skipped    int              `xml:"skipped,attr"`
+	Time       string           `xml:"time,attr"`
+	Timestamp  string           `xml:"timestamp,attr"`
+	Properties []junitProperty  `xml:"properties>property"`
+	Cases      []*junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+}
+
+type junitFailure struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// describe formats a difference event like check's error messages.
+func (e *Event) describe() string {
+	if e.ReferenceValue == "" && e.BackupValue == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: reference %s != backup %s", e.Message, e.ReferenceValue, e.BackupValue)
+}
+
+// JUnitReport writes a JUnit XML file with a testsuite for each pair and a
+// failing testcase for each difference. Differences of the "error" kind
+// (ex, unreadable files) are JUnit errors instead of failures.
+type JUnitReport struct {
+	path   string
+	report junitTestSuites
+	suite  *junitTestSuite
+}
+
+func NewJUnitReport(path string) *JUnitReport {
+	return &JUnitReport{
+		path: path,
+		report: junitTestSuites{
+			Name: "backup-chk",
+		},
+	}
+}
+
+func junitSeconds(seconds float64) string {
+	return fmt.Sprintf("%0.3f", seconds)
+}
+
+func (r *JUnitReport) Report(e *Event) {
+	switch e.Event {
+	case EVENT_PAIR_START:
+		r.suite = &junitTestSuite{
+			Name:      e.Reference + ":" + e.Backup,
+			Timestamp: e.Time.Format("2006-01-02T15:04:05"),
+			Properties: []junitProperty{
+				{"reference", e.Reference},
+				{"backup", e.Backup},
+			},
+		}
+		r.report.Suites = append(r.report.Suites, r.suite)
+
+	case EVENT_DIFFERENCE:
+		if r.suite == nil {
+			return
+		}
+		details := []string{"kind: " + e.Kind}
+		if e.ReferenceValue != "" || e.BackupValue != "" {
+			details = append(details, "reference: "+e.ReferenceValue, "backup: "+e.BackupValue)
+		}
+		if e.Offset != nil {
+			details = append(details, fmt.Sprintf("offset: %d", *e.Offset))
+		}
+		failure := &junitFailure{
+			Type:    e.Kind,
+			Message: e.Kind + ": " + e.describe(),
+			Text:    strings.Join(details, "\n"),
+		}
+		testCase := &junitTestCase{
+			Name:      e.Path,
+			ClassName: e.Reference,
+		}
+		if e.Kind == DIFF_ERROR {
+			testCase.Error = failure
+		} else {
+			testCase.Failure = failure
+		}
+		r.suite.Cases = append(r.suite.Cases, testCase)
+
+	case EVENT_PAIR_END:
+		if r.suite == nil || e.Summary == nil {
+			return
+		}
+		s := e.Summary
+		r.suite.Tests = s.Checked
+		// Only the testcases in the report are counted, since --only-new
+		// leaves out persisting differences
+		for _, testCase := range r.suite.Cases {
+			if testCase.Error != nil {
+				r.suite.Errors += 1
+			} else {
+				r.suite.Failures += 1
+			}
+		}
+		r.suite.Skipped = s.Changed + s.Filtered
+		r.suite.Time = junitSeconds(s.Finished.Sub(s.Started).Seconds())
+		r.suite.Properties = append(r.suite.Properties,
+			junitProperty{"result", s.Result},
+			junitProperty{"bytes", fmt.Sprint(s.Bytes)},
+			junitProperty{"differences", fmt.Sprint(s.Errors)},
+			junitProperty{"changed-since-backup", fmt.Sprint(s.Changed)},
+			junitProperty{"filtered", fmt.Sprint(s.Filtered)},
+			junitProperty{"pending", fmt.Sprint(s.Pending)},
+		)
+		r.report.Tests += r.suite.Tests
+		r.report.Failures += r.suite.Failures
+		r.report.Errors += r.suite.Errors
+		r.suite = nil
+
+	case EVENT_RUN_END:
+		if e.Summary != nil {
+			r.report.Time = junitSeconds(e.Summary.Finished.Sub(e.Summary.Started).Seconds())
+		}
+	}
+}
+
+// Close writes the report.
+func (r *JUnitReport) Close() error {
+	data, err := xml.MarshalIndent(&r.report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := r.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, append([]byte(xml.Header), append(data, '\n')...), 0644)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, r.path)
+}
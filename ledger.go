@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CoverageLedger records the last time each file in a pair was successfully
+// verified, and when the file had last changed at the time. It's stored in
+// the reference directory's run status directory, in a file for each backup
+// directory, one "<unix time>\t<changed at>\t<relative path>" line per file.
+type CoverageLedger struct {
+	path     string
+	verified map[string]ledgerEntry
+	dirty    bool
+}
+
+type ledgerEntry struct {
+	verified  int64
+	changedAt int64
+}
+
+func LoadCoverageLedger(runStatusDir string, bckKey string) (*CoverageLedger, error) {
+	name, err := runStatusName(bckKey)
+	if err != nil {
+		return nil, err
+	}
+	l := &CoverageLedger{
+		path:     path.Join(runStatusDir, "coverage-"+name),
+		verified: map[string]ledgerEntry{},
+	}
+
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		bits := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(bits) != 3 {
+			continue
+		}
+		verified, err := strconv.ParseInt(bits[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		changed, err := strconv.ParseInt(bits[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		l.verified[bits[2]] = ledgerEntry{verified, changed}
+	}
+
+	return l, scanner.Err()
+}
+
+// Record records that relPath, which last changed at changed, was verified at
+// when.
+func (l *CoverageLedger) Record(relPath string, when time.Time, changed time.Time) {
+	l.verified[relPath] = ledgerEntry{when.Unix(), changed.Unix()}
+	l.dirty = true
+}
+
+// LastVerified returns the zero time if relPath has never been verified.
+// changedSince is true if the file, which last changed at changed, has
+// changed since it was verified.
+func (l *CoverageLedger) LastVerified(relPath string, changed time.Time) (last time.Time, changedSince bool) {
+	entry, ok := l.verified[relPath]
+	if !ok {
+		return time.Time{}, false
+	}
+	ts := changed.Unix()
+	return time.Unix(entry.verified, 0), ts > entry.changedAt || ts > entry.verified
+}
+
+// Save does nothing if nothing has been recorded since the last save.
+func (l *CoverageLedger) Save() error {
+	if !l.dirty {
+		return nil
+	}
+	tmpPath := l.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(l.verified))
+	for p := range l.verified {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	w := bufio.NewWriter(f)
+	for _, p := range paths {
+		entry := l.verified[p]
+		fmt.Fprintf(w, "%d\t%d\t%s\n", entry.verified, entry.changedAt, p)
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, l.path)
+	if err == nil {
+		l.dirty = false
+	}
+	return err
+}
+
+type coverageEntry struct {
+	relPath      string
+	size         int64
+	lastVerified time.Time
+	changed      bool
+}
+
+// overdue is true if the entry hasn't been verified since cutoff, or has
+// changed since it was verified.
+func (e *coverageEntry) overdue(cutoff time.Time) bool {
+	return e.changed || e.lastVerified.Before(cutoff)
+}
+
+// walkCoverage lists every file under root along with when it was last
+// verified, and returns the walker it used so the paths it skipped can be
+// reported.
+func walkCoverage(ledger *CoverageLedger, root *WalkerItem, exclude *Excluder, seeds []string) ([]coverageEntry, *DFWalker, error) {
+	walker, err := NewDFWalker("", root, exclude, seeds)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer walker.Close()
+
+	entries := []coverageEntry{}
+	for {
+		item, err := walker.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if item == nil {
+			break
+		}
+		if item.IsDir() {
+			continue
+		}
+
+		stat, err := item.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		last, changed := ledger.LastVerified(item.RelPath(), changedAt(*stat))
+		entries = append(entries, coverageEntry{
+			relPath:      item.RelPath(),
+			size:         (*stat).Size(),
+			lastVerified: last,
+			changed:      changed,
+		})
+	}
+
+	return entries, walker, nil
+}
+
+// CoverageQueue yields the files under a root which haven't been verified
+// within the coverage window, most overdue first.
+type CoverageQueue struct {
+	root    *WalkerItem
+	entries []coverageEntry
+	marked  []string
+	skipped []SkippedPath
+}
+
+func NewCoverageQueue(ledger *CoverageLedger, root *WalkerItem, exclude *Excluder, seeds []string, days int) (*CoverageQueue, error) {
+	logger.Infof("Finding files which haven't been verified in the last %d days...", days)
+	entries, walker, err := walkCoverage(ledger, root, exclude, seeds)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -days)
+	overdue := []coverageEntry{}
+	for _, entry := range entries {
+		if entry.overdue(cutoff) {
+			overdue = append(overdue, entry)
+		}
+	}
+
+	sort.Slice(overdue, func(i, j int) bool {
+		a, b := overdue[i], overdue[j]
+		if !a.lastVerified.Equal(b.lastVerified) {
+			return a.lastVerified.Before(b.lastVerified)
+		}
+		return a.relPath < b.relPath
+	})
+
+	logger.Infof(
+		"%s of %s files are due for verification",
+		FormatInt(len(overdue)),
+		FormatInt(len(entries)),
+	)
+
+	return &CoverageQueue{
+		root:    root,
+		entries: overdue,
+		marked:  walker.Marked(),
+		skipped: walker.Skipped(),
+	}, nil
+}
+
+func (q *CoverageQueue) Next() (*WalkerItem, error) {
+	for len(q.entries) > 0 {
+		entry := q.entries[0]
+		q.entries = q.entries[1:]
+		itemPath := path.Join(q.root.path, entry.relPath)
+		stat, err := os.Lstat(itemPath)
+		if os.IsNotExist(err) {
+			logger.Debugf("%s: deleted since the queue was built; skipping", entry.relPath)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return WalkerItemFromFile(q.root.root, itemPath, &stat), nil
+	}
+	return nil, nil
+}
+
+func (q *CoverageQueue) Pending() int {
+	return len(q.entries)
+}
+
+func (q *CoverageQueue) Marked() []string {
+	return q.marked
+}
+
+// Skipped returns the paths which were excluded (or not found) when the
+// queue was built, the first time it's called.
+func (q *CoverageQueue) Skipped() []SkippedPath {
+	res := q.skipped
+	q.skipped = nil
+	return res
+}
+
+func (q *CoverageQueue) Close() {}
+
+func showCoverageReport(out io.Writer, pairs []Pair, stateDir string, exclude *Excluder, days int) error {
+	cutoff := time.Now().AddDate(0, 0, -days)
+	for _, pair := range pairs {
+		runStatusDir, err := runStatusDirFor(stateDir, pair.ref)
+		if err != nil {
+			return err
+		}
+
+		ledger, err := LoadCoverageLedger(runStatusDir, pair.bckKey)
+		if err != nil {
+			return err
+		}
+
+		entries, _, err := walkCoverage(ledger, pair.ref, exclude, pair.seeds)
+		if err != nil {
+			return err
+		}
+
+		var files, covered, never int
+		var bytes, coveredBytes int64
+		oldest := time.Time{}
+		for _, entry := range entries {
+			files += 1
+			bytes += entry.size
+			if entry.lastVerified.IsZero() {
+				never += 1
+				continue
+			}
+			if !entry.overdue(cutoff) {
+				covered += 1
+				coveredBytes += entry.size
+			}
+			if oldest.IsZero() || entry.lastVerified.Before(oldest) {
+				oldest = entry.lastVerified
+			}
+		}
+
+		pct := func(a, b int64) float64 {
+			if b == 0 {
+				return 100
+			}
+			return float64(a) / float64(b) * 100
+		}
+
+		fmt.Fprintf(out, "%s:\n", *pair.ref.root)
+		fmt.Fprintf(out, "  Backup: %s\n", pair.bckKey)
+		fmt.Fprintf(out, "  %s of %s files (%0.1f%%) verified in the last %d days\n",
+			FormatInt(covered), FormatInt(files), pct(int64(covered), int64(files)), days)
+		fmt.Fprintf(out, "  %s of %s bytes (%0.1f%%) verified in the last %d days\n",
+			FormatInt(coveredBytes), FormatInt(bytes), pct(coveredBytes, bytes), days)
+		fmt.Fprintf(out, "  %s files have never been verified\n", FormatInt(never))
+		if !oldest.IsZero() {
+			fmt.Fprintf(out, "  Oldest verification: %s\n", oldest.Format("2006-01-02 15:04:05"))
+		}
+	}
+
+	return nil
+}
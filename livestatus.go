@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LIVE_STATUS_RECENT_DIFFS is the number of differences kept for the live
+// status page.
+const LIVE_STATUS_RECENT_DIFFS = 20
+
+type liveStatusSnapshot struct {
+	Started           time.Time     `json:"started"`
+	Now               time.Time     `json:"now"`
+	State             string        `json:"state"`
+	Pair              int           `json:"pair"`
+	Pairs             int           `json:"pairs"`
+	Reference         string        `json:"reference"`
+	Backup            string        `json:"backup"`
+	Path              string        `json:"path"`
+	Checked           int           `json:"checked"`
+	Errors            int           `json:"errors"`
+	Pending           int           `json:"pending"`
+	BytesRead         uint64        `json:"bytes_read"`
+	BytesPerSecond    float64       `json:"bytes_per_second"`
+	RecentDifferences []*Event      `json:"recent_differences"`
+	Finished          []*PairResult `json:"finished"`
+}
+
+// LiveStatus serves the progress of a run over HTTP, as JSON at
+// /status.json and as a page which refreshes itself at /. It's updated by
+// the checking loop and, as a Reporter, by the run's events.
+type LiveStatus struct {
+	listener net.Listener
+	server   *http.Server
+
+	lock     sync.Mutex
+	snapshot liveStatusSnapshot
+}
+
+func NewLiveStatus(addr string, pairs int) (*LiveStatus, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &LiveStatus{
+		listener: listener,
+		snapshot: liveStatusSnapshot{
+			Started:           time.Now(),
+			State:             "starting",
+			Pairs:             pairs,
+			RecentDifferences: []*Event{},
+			Finished:          []*PairResult{},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveHTML)
+	mux.HandleFunc("/status.json", s.serveJSON)
+	s.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go s.server.Serve(listener)
+
+	logger.Infof("Serving status at http://%s/", listener.Addr())
+	return s, nil
+}
+
+// Update records the item which is about to be checked. It does nothing if
+// s is nil, so it can be called whether or not --status-addr is used.
+func (s *LiveStatus) Update(path string, checked int, errors int, pending int, bytesRead uint64) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.snapshot.Path = path
+	s.snapshot.Checked = checked
+	s.snapshot.Errors = errors
+	s.snapshot.Pending = pending
+	s.snapshot.BytesRead = bytesRead
+}
+
+func (s *LiveStatus) Report(e *Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch e.Event {
+	case EVENT_PAIR_START:
+		s.snapshot.State = "checking"
+		s.snapshot.Pair += 1
+		s.snapshot.Reference = e.Reference
+		s.snapshot.Backup = e.Backup
+		s.snapshot.Path = ""
+		s.snapshot.Checked = 0
+		s.snapshot.Errors = 0
+	case EVENT_DIFFERENCE:
+		recent := append(s.snapshot.RecentDifferences, e)
+		if len(recent) > LIVE_STATUS_RECENT_DIFFS {
+			recent = recent[len(recent)-LIVE_STATUS_RECENT_DIFFS:]
+		}
+		s.snapshot.RecentDifferences = recent
+	case EVENT_PAIR_END:
+		if e.Summary != nil {
+			s.snapshot.Finished = append(s.snapshot.Finished, e.Summary)
+		}
+	case EVENT_RUN_END:
+		s.snapshot.State = "finished"
+		s.snapshot.Path = ""
+	}
+}
+
+func (s *LiveStatus) Close() error {
+	return s.server.Close()
+}
+
+func (s *LiveStatus) current() liveStatusSnapshot {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := s.snapshot
+	res.Now = time.Now()
+	if elapsed := res.Now.Sub(res.Started).Seconds(); elapsed > 0 {
+		res.BytesPerSecond = float64(res.BytesRead) / elapsed
+	}
+	// Copied so they can't change while they're being written
+	res.RecentDifferences = append([]*Event{}, res.RecentDifferences...)
+	res.Finished = append([]*PairResult{}, res.Finished...)
+	return res
+}
+
+func allowReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func (s *LiveStatus) serveJSON(w http.ResponseWriter, r *http.Request) {
+	if !allowReadOnly(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.current())
+}
+
+var liveStatusTemplate = template.Must(template.New("status").Funcs(htmlReportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>backup-chk: {{ .State }}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; vertical-align: top; }
+.path { font-family: Menlo, Consolas, monospace; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>backup-chk: {{ .State }}</h1>
+<table>
+<tr><th>Started</th><td>{{ time .Started }}</td></tr>
+<tr><th>Pair</th><td>{{ .Pair }} of {{ .Pairs }}: <span class="path">{{ .Reference }}</span> &rarr; <span class="path">{{ .Backup }}</span></td></tr>
+<tr><th>Checking</th><td class="path">{{ .Path }}</td></tr>
+<tr><th>Progress</th><td>{{ int .Checked }} checked, {{ int .Errors }} differences, {{ int .Pending }} pending</td></tr>
+<tr><th>Read</th><td>{{ int .BytesRead }} bytes ({{ printf "%0.02f" .BytesPerSecond }} bytes/s)</td></tr>
+</table>
+{{ if .RecentDifferences }}
+<h2>Recent differences</h2>
+<ul>
+{{ range .RecentDifferences }}<li><span class="path">{{ .Path }}</span>: {{ .Kind }}: {{ .Message }}</li>
+{{ end }}</ul>
+{{ end }}
+{{ if .Finished }}
+<h2>Finished pairs</h2>
+<ul>
+{{ range .Finished }}<li><span class="path">{{ .Reference }}</span>: {{ .Result }}, {{ int .Checked }} checked, {{ int .Errors }} differences</li>
+{{ end }}</ul>
+{{ end }}
+<p><a href="status.json">status.json</a></p>
+</body>
+</html>
+`))
+
+func (s *LiveStatus) serveHTML(w http.ResponseWriter, r *http.Request) {
+	if !allowReadOnly(w, r) {
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	liveStatusTemplate.Execute(w, s.current())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsReport writes Prometheus metrics for each pair in the text format,
+// to a file for node_exporter's textfile collector and/or to a Pushgateway.
+// They're written at the end of each pair, and include every pair checked
+// so far.
+type MetricsReport struct {
+	path    string
+	pushURL string
+	client  *http.Client
+	results []*PairResult
+}
+
+func NewMetricsReport(path string, pushgateway string) (*MetricsReport, error) {
+	r := &MetricsReport{
+		path:   path,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if pushgateway != "" {
+		u, err := url.Parse(pushgateway)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid --pushgateway URL: %s", pushgateway)
+		}
+		host, err := os.Hostname()
+		if err != nil {
+			host = "unknown"
+		}
+		r.pushURL = strings.TrimRight(pushgateway, "/") +
+			"/metrics/job/backup-chk/instance/" + url.PathEscape(host)
+	}
+
+	return r, nil
+}
+
+// metricLabel quotes a label value as the text format requires.
+func metricLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return `"` + value + `"`
+}
+
+type metricWriter struct {
+	out     io.Writer
+	written map[string]bool
+}
+
+func (w *metricWriter) write(name string, help string, labels string, value float64) {
+	if !w.written[name] {
+		fmt.Fprintf(w.out, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w.out, "# TYPE %s gauge\n", name)
+		w.written[name] = true
+	}
+	fmt.Fprintf(w.out, "%s{%s} %s\n", name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// writeMetrics writes results in the Prometheus text format. Metrics with
+// the same name have to be together, so it loops over them for each metric.
+func writeMetrics(out io.Writer, results []*PairResult) {
+	w := &metricWriter{out: out, written: map[string]bool{}}
+
+	kinds := make([]string, 0, len(diffKinds))
+	for kind := range diffKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	type metric struct {
+		name  string
+		help  string
+		value func(r *PairResult) float64
+	}
+	metrics := []metric{
+		{"backup_chk_files_checked", "Files checked by the last run.", func(r *PairResult) float64 { return float64(r.Checked) }},
+		{"backup_chk_bytes_read", "Bytes read from the reference by the last run.", func(r *PairResult) float64 { return float64(r.Bytes) }},
+		{"backup_chk_changed_since_backup", "Files which changed after the backup was taken.", func(r *PairResult) float64 { return float64(r.Changed) }},
+		{"backup_chk_filtered", "Files skipped by --min-size, --type, etc.", func(r *PairResult) float64 { return float64(r.Filtered) }},
+		{"backup_chk_pending", "Items left for the next run when the last run stopped early.", func(r *PairResult) float64 { return float64(r.Pending) }},
+		{"backup_chk_duration_seconds", "How long the last run took.", func(r *PairResult) float64 { return r.Finished.Sub(r.Started).Seconds() }},
+		{"backup_chk_last_run_timestamp_seconds", "When the last run finished.", func(r *PairResult) float64 { return float64(r.Finished.Unix()) }},
+	}
+
+	labelsFor := func(r *PairResult) string {
+		return "reference=" + metricLabel(r.Reference) + ",backup=" + metricLabel(r.Backup)
+	}
+
+	for _, m := range metrics {
+		for _, r := range results {
+			w.write(m.name, m.help, labelsFor(r), m.value(r))
+		}
+	}
+
+	for _, r := range results {
+		for _, kind := range kinds {
+			w.write("backup_chk_differences", "Differences found by the last run, by kind.",
+				labelsFor(r)+",kind="+metricLabel(kind), float64(r.Diffs[kind]))
+		}
+	}
+
+	for _, r := range results {
+		if !r.LastSuccess.IsZero() {
+			w.write("backup_chk_last_success_timestamp_seconds", "When the pair was last completely checked without failing differences.",
+				labelsFor(r), float64(r.LastSuccess.Unix()))
+		}
+	}
+}
+
+func (r *MetricsReport) Report(e *Event) {
+	if e.Event != EVENT_PAIR_END || e.Summary == nil {
+		return
+	}
+
+	r.results = append(r.results, e.Summary)
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, r.results)
+
+	if r.path != "" {
+		err := r.writeFile(buf.Bytes())
+		if err != nil {
+			logger.Errorf("Error writing metrics to %s: %s", r.path, err)
+		}
+	}
+
+	if r.pushURL != "" {
+		err := r.push(buf.Bytes())
+		if err != nil {
+			logger.Errorf("Error pushing metrics to %s: %s", r.pushURL, err)
+		}
+	}
+}
+
+// writeFile replaces the metrics file atomically, so the textfile collector
+// never reads a partial file.
+func (r *MetricsReport) writeFile(data []byte) error {
+	tmpPath := r.path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, r.path)
+}
+
+// push replaces the metrics of this job and instance on the Pushgateway.
+func (r *MetricsReport) push(data []byte) error {
+	req, err := http.NewRequest("PUT", r.pushURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (r *MetricsReport) Close() error {
+	return nil
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// DecodePlist decodes an XML or binary property list. Values are returned as
+// map[string]interface{}, []interface{}, string, int64, float64, bool,
+// time.Time, or []byte.
+func DecodePlist(data []byte) (interface{}, error) {
+	if bytes.HasPrefix(data, []byte("bplist00")) {
+		return decodeBinaryPlist(data)
+	}
+	return decodeXMLPlist(data)
+}
+
+var ERR_PLIST_NOT_DICT = errors.New("plist is not a dictionary")
+
+var plistEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func decodeXMLPlist(data []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, errors.New("error parsing plist: no <plist> element")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "plist" {
+			return decodeXMLPlistValue(d, start)
+		}
+
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				return decodeXMLPlistValue(d, t)
+			case xml.EndElement:
+				return nil, errors.New("error parsing plist: empty <plist>")
+			}
+		}
+	}
+}
+
+func decodeXMLPlistValue(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		res := map[string]interface{}{}
+		key := (*string)(nil)
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "key" {
+					var k string
+					err := d.DecodeElement(&k, &t)
+					if err != nil {
+						return nil, err
+					}
+					key = &k
+					continue
+				}
+				if key == nil {
+					return nil, errors.New("error parsing plist: <" + t.Name.Local + "> in <dict> without a <key>")
+				}
+				val, err := decodeXMLPlistValue(d, t)
+				if err != nil {
+					return nil, err
+				}
+				res[*key] = val
+				key = nil
+			case xml.EndElement:
+				return res, nil
+			}
+		}
+
+	case "array":
+		res := []interface{}{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				val, err := decodeXMLPlistValue(d, t)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, val)
+			case xml.EndElement:
+				return res, nil
+			}
+		}
+
+	case "true", "false":
+		err := d.Skip()
+		return start.Name.Local == "true", err
+	}
+
+	var text string
+	err := d.DecodeElement(&text, &start)
+	if err != nil {
+		return nil, err
+	}
+
+	switch start.Name.Local {
+	case "string":
+		return text, nil
+	case "integer":
+		text = strings.TrimSpace(text)
+		if i, err := strconv.ParseInt(text, 0, 64); err == nil {
+			return i, nil
+		}
+		u, err := strconv.ParseUint(text, 0, 64)
+		if err != nil {
+			return nil, errors.New("error parsing plist: invalid <integer>: " + text)
+		}
+		return int64(u), nil
+	case "real":
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, errors.New("error parsing plist: invalid <real>: " + text)
+		}
+		return f, nil
+	case "date":
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(text))
+		if err != nil {
+			return nil, errors.New("error parsing plist: invalid <date>: " + text)
+		}
+		return t, nil
+	case "data":
+		clean := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+				return -1
+			}
+			return r
+		}, text)
+		return base64.StdEncoding.DecodeString(clean)
+	}
+
+	return nil, errors.New("error parsing plist: unexpected element: <" + start.Name.Local + ">")
+}
+
+type binaryPlist struct {
+	data        []byte
+	offsets     []uint64
+	refSize     int
+	objectDepth int
+
+	// Objects can be referred to more than once, so each is only decoded once
+	decoded map[uint64]interface{}
+}
+
+func decodeBinaryPlist(data []byte) (interface{}, error) {
+	if len(data) < 8+32 {
+		return nil, errors.New("error parsing binary plist: too short")
+	}
+
+	trailer := data[len(data)-32:]
+	offsetSize := int(trailer[6])
+	refSize := int(trailer[7])
+	numObjects := binary.BigEndian.Uint64(trailer[8:16])
+	topObject := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 {
+		return nil, errors.New("error parsing binary plist: invalid trailer")
+	}
+	tableEnd := uint64(len(data) - 32)
+	if tableOffset > tableEnd || numObjects > (tableEnd-tableOffset)/uint64(offsetSize) {
+		return nil, errors.New("error parsing binary plist: invalid offset table")
+	}
+
+	p := &binaryPlist{
+		data:    data[:tableOffset],
+		offsets: make([]uint64, numObjects),
+		refSize: refSize,
+		decoded: map[uint64]interface{}{},
+	}
+	for i := range p.offsets {
+		start := tableOffset + uint64(i*offsetSize)
+		p.offsets[i] = readBigEndian(data[start : start+uint64(offsetSize)])
+	}
+
+	return p.object(topObject)
+}
+
+func readBigEndian(b []byte) uint64 {
+	res := uint64(0)
+	for _, c := range b {
+		res = res<<8 | uint64(c)
+	}
+	return res
+}
+
+func (p *binaryPlist) bytes(offset uint64, n uint64) ([]byte, error) {
+	if offset > uint64(len(p.data)) || n > uint64(len(p.data))-offset {
+		return nil, errors.New("error parsing binary plist: object out of range")
+	}
+	return p.data[offset : offset+n], nil
+}
+
+// length reads the length of the object at offset, returning the length and
+// the offset of the object's contents.
+func (p *binaryPlist) length(offset uint64) (uint64, uint64, error) {
+	info := uint64(p.data[offset] & 0x0F)
+	offset += 1
+	if info != 0x0F {
+		return info, offset, nil
+	}
+
+	marker, err := p.bytes(offset, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if marker[0]&0xF0 != 0x10 {
+		return 0, 0, errors.New("error parsing binary plist: invalid length")
+	}
+	size := uint64(1) << (marker[0] & 0x0F)
+	b, err := p.bytes(offset+1, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	return readBigEndian(b), offset + 1 + size, nil
+}
+
+func (p *binaryPlist) refs(offset uint64, count uint64) ([]uint64, error) {
+	if count > uint64(len(p.data))/uint64(p.refSize) {
+		return nil, errors.New("error parsing binary plist: object out of range")
+	}
+	b, err := p.bytes(offset, count*uint64(p.refSize))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]uint64, count)
+	for i := range res {
+		res[i] = readBigEndian(b[i*p.refSize : (i+1)*p.refSize])
+	}
+	return res, nil
+}
+
+func (p *binaryPlist) object(ref uint64) (interface{}, error) {
+	if res, ok := p.decoded[ref]; ok {
+		return res, nil
+	}
+	res, err := p.decode(ref)
+	if err != nil {
+		return nil, err
+	}
+	p.decoded[ref] = res
+	return res, nil
+}
+
+func (p *binaryPlist) decode(ref uint64) (interface{}, error) {
+	if ref >= uint64(len(p.offsets)) {
+		return nil, errors.New("error parsing binary plist: invalid object reference")
+	}
+
+	// Containers can refer to themselves; don't recurse forever.
+	p.objectDepth += 1
+	defer func() { p.objectDepth -= 1 }()
+	if p.objectDepth > 512 {
+		return nil, errors.New("error parsing binary plist: objects nested too deeply")
+	}
+
+	offset := p.offsets[ref]
+	if offset >= uint64(len(p.data)) {
+		return nil, errors.New("error parsing binary plist: object out of range")
+	}
+	marker := p.data[offset]
+	info := marker & 0x0F
+
+	switch marker & 0xF0 {
+	case 0x00:
+		switch marker {
+		case 0x08:
+			return false, nil
+		case 0x09:
+			return true, nil
+		}
+		return nil, nil
+
+	case 0x10:
+		size := uint64(1) << info
+		b, err := p.bytes(offset+1, size)
+		if err != nil {
+			return nil, err
+		}
+		if size > 8 {
+			b = b[size-8:]
+		}
+		return int64(readBigEndian(b)), nil
+
+	case 0x20, 0x30:
+		size := uint64(1) << info
+		if marker&0xF0 == 0x30 {
+			size = 8
+		}
+		b, err := p.bytes(offset+1, size)
+		if err != nil {
+			return nil, err
+		}
+		var f float64
+		switch size {
+		case 4:
+			f = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		case 8:
+			f = math.Float64frombits(binary.BigEndian.Uint64(b))
+		default:
+			return nil, fmt.Errorf("error parsing binary plist: invalid real size: %d", size)
+		}
+		if marker&0xF0 == 0x30 {
+			secs, frac := math.Modf(f)
+			return plistEpoch.Add(time.Duration(secs)*time.Second + time.Duration(frac*float64(time.Second))), nil
+		}
+		return f, nil
+
+	case 0x40, 0x50, 0x60:
+		count, start, err := p.length(offset)
+		if err != nil {
+			return nil, err
+		}
+		if marker&0xF0 == 0x60 {
+			// UTF-16, so there are two bytes per character
+			if count > uint64(len(p.data))/2 {
+				return nil, errors.New("error parsing binary plist: object out of range")
+			}
+			b, err := p.bytes(start, count*2)
+			if err != nil {
+				return nil, err
+			}
+			chars := make([]uint16, count)
+			for i := range chars {
+				chars[i] = binary.BigEndian.Uint16(b[i*2:])
+			}
+			return string(utf16.Decode(chars)), nil
+		}
+		b, err := p.bytes(start, count)
+		if err != nil {
+			return nil, err
+		}
+		if marker&0xF0 == 0x50 {
+			return string(b), nil
+		}
+		return append([]byte{}, b...), nil
+
+	case 0x80:
+		b, err := p.bytes(offset+1, uint64(info)+1)
+		if err != nil {
+			return nil, err
+		}
+		return int64(readBigEndian(b)), nil
+
+	case 0xA0, 0xC0:
+		count, start, err := p.length(offset)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := p.refs(start, count)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]interface{}, len(refs))
+		for i, ref := range refs {
+			res[i], err = p.object(ref)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+
+	case 0xD0:
+		count, start, err := p.length(offset)
+		if err != nil {
+			return nil, err
+		}
+		// The keys' refs, then the values'
+		if count > uint64(len(p.data))/2 {
+			return nil, errors.New("error parsing binary plist: object out of range")
+		}
+		refs, err := p.refs(start, count*2)
+		if err != nil {
+			return nil, err
+		}
+		res := map[string]interface{}{}
+		for i := uint64(0); i < count; i++ {
+			key, err := p.object(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, errors.New("error parsing binary plist: dict key is not a string")
+			}
+			res[keyStr], err = p.object(refs[count+i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("error parsing binary plist: unknown object type: 0x%02x", marker)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testXMLPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>string</key>
+	<string>café ☃</string>
+	<key>int</key>
+	<integer>42</integer>
+	<key>negative</key>
+	<integer>-7</integer>
+	<key>big</key>
+	<integer>18446744073709551615</integer>
+	<key>real</key>
+	<real>1.5</real>
+	<key>date</key>
+	<date>2017-02-20T15:37:00Z</date>
+	<key>data</key>
+	<data>
+	AAEC
+	</data>
+	<key>true</key>
+	<true/>
+	<key>false</key>
+	<false/>
+	<key>array</key>
+	<array>
+		<string>a</string>
+		<integer>1</integer>
+	</array>
+	<key>dict</key>
+	<dict>
+		<key>nested</key>
+		<string>yes</string>
+	</dict>
+</dict>
+</plist>
+`
+
+// Python's plistlib.dumps({...}, fmt=plistlib.FMT_BINARY, sort_keys=True)
+// of the values in TestDecodeBinaryPlist
+const testBinaryPlist = "" +
+	"62706c6973743030de0102030405060708090a0b0c0d0e0f1213141518191a1b" +
+	"1c1d1e1f20556172726179536269675464617461546461746554646963745566" +
+	"616c736553696e74546c6f6e67586e65676174697665547265616c5673747269" +
+	"6e6754747275655375696457756e69636f6465a2101151611001130000010000" +
+	"000000430001023341be5b449c000000d11617566e6573746564537965730810" +
+	"2a5f10226120737472696e67206c6f6e676572207468616e206669667465656e" +
+	"20627974657313fffffffffffffff9233ff80000000000005568656c6c6f0980" +
+	"036600630061006600e90020260308252b2f34393e44484d565b62676b737678" +
+	"7a838790939a9e9fa1c6cfd8dedfe10000000000000101000000000000002100" +
+	"0000000000000000000000000000ee"
+
+// {"SkipPaths": ["/Users/bob/big", "~/Movies"], "ExcludeByPath":
+// ["/Volumes/x", ""], "AutoBackup": true}, as a binary plist
+const testTMPreferences = "" +
+	"62706c6973743030d30102030405085a4175746f4261636b75705d4578636c75" +
+	"646542795061746859536b6970506174687309a206075a2f566f6c756d65732f" +
+	"7850a2090a5e2f55736572732f626f622f626967587e2f4d6f76696573080f1a" +
+	"28323336414245540000000000000101000000000000000b0000000000000000" +
+	"000000000000005d"
+
+const testStdExclusions = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>PathsExcluded</key>
+	<array>
+		<string>/private/var/vm</string>
+		<string>/Users/alice/tmp</string>
+	</array>
+	<key>UserPathsExcluded</key>
+	<array>
+		<string>~/Library/Caches</string>
+	</array>
+	<key>FileContentsExcluded</key>
+	<array>
+		<string>/Users/alice/db.sqlite</string>
+	</array>
+	<key>ContentsExcluded</key>
+	<array>
+		<string>/Users/alice/Downloads/</string>
+	</array>
+	<key>ContentsExcludedByStdExclusions</key>
+	<array>
+		<string>Library/Logs</string>
+	</array>
+</dict>
+</plist>
+`
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	res, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestDecodeXMLPlist(t *testing.T) {
+	val, err := DecodePlist([]byte(testXMLPlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"string":   "café ☃",
+		"int":      int64(42),
+		"negative": int64(-7),
+		"big":      int64(-1),
+		"real":     1.5,
+		"date":     time.Date(2017, 2, 20, 15, 37, 0, 0, time.UTC),
+		"data":     []byte{0, 1, 2},
+		"true":     true,
+		"false":    false,
+		"array":    []interface{}{"a", int64(1)},
+		"dict":     map[string]interface{}{"nested": "yes"},
+	}
+	if !reflect.DeepEqual(val, expected) {
+		t.Errorf("got %#v, expected %#v", val, expected)
+	}
+}
+
+func TestDecodeXMLPlistErrors(t *testing.T) {
+	for _, data := range []string{
+		``,
+		`<plist></plist>`,
+		`<plist><dict><string>no key</string></dict></plist>`,
+		`<plist><integer>x</integer></plist>`,
+		`<plist><date>yesterday</date></plist>`,
+		`<plist><set/></plist>`,
+	} {
+		_, err := DecodePlist([]byte(data))
+		if err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
+
+func TestDecodeBinaryPlist(t *testing.T) {
+	val, err := DecodePlist(mustDecodeHex(t, testBinaryPlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"string":   "hello",
+		"long":     "a string longer than fifteen bytes",
+		"unicode":  "café ☃",
+		"int":      int64(42),
+		"negative": int64(-7),
+		"big":      int64(1 << 40),
+		"real":     1.5,
+		"date":     time.Date(2017, 2, 20, 15, 37, 0, 0, time.UTC),
+		"data":     []byte{0, 1, 2},
+		"true":     true,
+		"false":    false,
+		"array":    []interface{}{"a", int64(1)},
+		"dict":     map[string]interface{}{"nested": "yes"},
+		"uid":      int64(3),
+	}
+	dict, ok := val.(map[string]interface{})
+	if !ok {
+		t.Fatalf("got %#v, expected a dict", val)
+	}
+	if date, ok := dict["date"].(time.Time); ok {
+		dict["date"] = date.UTC()
+	}
+	if !reflect.DeepEqual(dict, expected) {
+		t.Errorf("got %#v, expected %#v", dict, expected)
+	}
+}
+
+// binaryPlistWith returns a binary plist of objects, the first of which is
+// the top object.
+func binaryPlistWith(objects ...[]byte) []byte {
+	res := []byte("bplist00")
+	offsets := []byte{}
+	for _, object := range objects {
+		offsets = append(offsets, byte(len(res)))
+		res = append(res, object...)
+	}
+	tableOffset := len(res)
+	res = append(res, offsets...)
+	trailer := make([]byte, 32)
+	trailer[6] = 1 // offset size
+	trailer[7] = 1 // ref size
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(len(objects)))
+	binary.BigEndian.PutUint64(trailer[16:24], 0)
+	binary.BigEndian.PutUint64(trailer[24:32], uint64(tableOffset))
+	return append(res, trailer...)
+}
+
+func TestDecodeBinaryPlistErrors(t *testing.T) {
+	huge := []byte{0x13, 0x80, 0, 0, 0, 0, 0, 0, 1}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", []byte("bplist00")},
+		{"bad trailer", append([]byte("bplist00"), make([]byte, 32)...)},
+		{"string past the end", binaryPlistWith([]byte{0x55, 'a', 'b'})},
+		{"utf-16 string count overflows", binaryPlistWith(append(append([]byte{0x6F}, huge...), 0, 'a'))},
+		{"array count too big", binaryPlistWith(append([]byte{0xAF}, huge...))},
+		{"dict count overflows", binaryPlistWith(append(append([]byte{0xDF}, huge...), 1, 1), []byte{0x51, 'k'})},
+		{"array contains itself", binaryPlistWith([]byte{0xA1, 0})},
+		{"dict key isn't a string", binaryPlistWith([]byte{0xD1, 0, 0})},
+		{"unknown type", binaryPlistWith([]byte{0xF0})},
+	}
+	for _, test := range tests {
+		_, err := DecodePlist(test.data)
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestDecodeBinaryPlistSharedObjects(t *testing.T) {
+	// Each array refers to the next one twice, so decoding every reference
+	// separately would take 2^40 steps
+	const depth = 40
+	objects := [][]byte{}
+	for i := 0; i < depth; i++ {
+		objects = append(objects, []byte{0xA2, byte(i + 1), byte(i + 1)})
+	}
+	objects = append(objects, []byte{0x10, 7})
+
+	done := make(chan error, 1)
+	go func() {
+		val, err := DecodePlist(binaryPlistWith(objects...))
+		for i := 0; err == nil && i < depth; i++ {
+			array, ok := val.([]interface{})
+			if !ok || len(array) != 2 {
+				err = fmt.Errorf("level %d: got %#v, expected an array of 2", i, val)
+				break
+			}
+			val = array[1]
+		}
+		if err == nil && val != int64(7) {
+			err = fmt.Errorf("got %#v at the bottom, expected 7", val)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("decoding shared objects didn't finish")
+	}
+}
+
+func TestLoadTimeMachineExclusions(t *testing.T) {
+	dir := t.TempDir()
+	stdPath := path.Join(dir, "StdExclusions.plist")
+	prefsPath := path.Join(dir, "com.apple.TimeMachine.plist")
+	err := ioutil.WriteFile(stdPath, []byte(testStdExclusions), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(prefsPath, mustDecodeHex(t, testTMPreferences), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := loadTimeMachineExclusions(stdPath, prefsPath, []string{"/Users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/alice/tmp",
+		"**/Library/Caches",
+		"/alice/db.sqlite",
+		"/bob/big",
+		"**/Movies",
+		"/alice/Downloads/**",
+		"**/Library/Logs/**",
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("got %q, expected %q", res, expected)
+	}
+
+	// They're anchored, and only match whole path segments
+	rules, err := ParseIgnoreRules(strings.NewReader(strings.Join(res, "\n")), stdPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for relPath, excluded := range map[string]bool{
+		"alice/tmp":                       true,
+		"alice/tmp/a":                     false, // inside an excluded directory, which isn't walked
+		"alice/Projects/htmpl.txt":        false,
+		"alice/tmpfile":                   false,
+		"xalice/tmp":                      false,
+		"bob/big":                         true,
+		"xbob/bigfile":                    false,
+		"bob/bigfile":                     false,
+		"Movies":                          true,
+		"alice/Movies":                    true,
+		"alice/Library/Caches":            true,
+		"alice/Downloads":                 false,
+		"alice/Downloads/a.dmg":           true,
+		"alice/Library/Logs/x/y.log":      true,
+		"alice/Library/LogsAndMore/y.log": false,
+	} {
+		if res := rules.match(relPath, false) != nil; res != excluded {
+			t.Errorf("%s: got %v, expected %v", relPath, res, excluded)
+		}
+	}
+
+	res, err = loadTimeMachineExclusions(stdPath, "", []string{"/Users/alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"/tmp", "**/Library/Caches", "/db.sqlite", "/Downloads/**", "**/Library/Logs/**"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("got %q, expected %q", res, expected)
+	}
+
+	_, err = loadTimeMachineExclusions(path.Join(dir, "missing.plist"), "", nil)
+	if err == nil {
+		t.Errorf("expected an error for a missing plist")
+	}
+
+	err = ioutil.WriteFile(stdPath, []byte(`<plist><array/></plist>`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadTimeMachineExclusions(stdPath, "", nil)
+	if err != ERR_PLIST_NOT_DICT {
+		t.Errorf("got %v, expected %v", err, ERR_PLIST_NOT_DICT)
+	}
+}
+
+func TestTMExcludePattern(t *testing.T) {
+	tests := []struct {
+		path     string
+		pattern  string
+		relPath  string
+		excluded bool
+	}{
+		{"/Users/a*b?[c]", "/a\\*b\\?\\[c]", "a*b?[c]", true},
+		{"/Users/a*b?[c]", "/a\\*b\\?\\[c]", "axxb1c", false},
+		{"~/Library/Caches/", "**/Library/Caches", "bob/Library/Caches", true},
+		{"/Users", "", "", false},
+		{"/Volumes/x", "", "", false},
+		{"~/", "", "", false},
+	}
+	for _, test := range tests {
+		pattern, ok := tmExcludePattern(test.path, []string{"/Users"})
+		if pattern != test.pattern || ok != (test.pattern != "") {
+			t.Errorf("%s: got %q (%v), expected %q", test.path, pattern, ok, test.pattern)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		rules, err := ParseIgnoreRules(strings.NewReader(pattern), "test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := rules.match(test.relPath, false) != nil; res != test.excluded {
+			t.Errorf("%s matching %s: got %v, expected %v", pattern, test.relPath, res, test.excluded)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotGuess is the result of finding a snapshot in a backup tool's
+// directory layout.
+type SnapshotGuess struct {
+	Layout    string
+	Name      string
+	Directory string
+	Time      time.Time
+
+	// ROOT/SUBPATH of the specifier, which stays the same as new snapshots
+	// are taken
+	Root string
+}
+
+type snapshotLayout func(root string, name string) (*SnapshotGuess, error)
+
+var snapshotLayouts = map[string]snapshotLayout{
+	"rsnapshot": findRsnapshotSnapshot,
+	"snapper":   findSnapperSnapshot,
+	"zfs":       findZFSSnapshot,
+}
+
+var rsnapshotNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+\.[0-9]+$`)
+
+// parseSnapshotSpec parses backup specifiers like:
+//
+//	rsnapshot:/backups/daily.0
+//	rsnapshot:/backups@latest/localhost/home
+//	snapper:/home@42
+//	zfs-latest:/tank/home
+//
+// The general form is LAYOUT:ROOT[@SNAPSHOT[/SUBPATH]], where SNAPSHOT
+// defaults to "latest", and LAYOUT-latest:ROOT is short for
+// LAYOUT:ROOT@latest. ok is false if spec doesn't name a known layout.
+func parseSnapshotSpec(spec string) (guess *SnapshotGuess, ok bool, err error) {
+	bits := strings.SplitN(spec, ":", 2)
+	if len(bits) != 2 {
+		return nil, false, nil
+	}
+
+	layoutName := strings.TrimSuffix(bits[0], "-latest")
+	layout, ok := snapshotLayouts[layoutName]
+	if !ok {
+		return nil, false, nil
+	}
+
+	root := bits[1]
+	name := "latest"
+	subpath := ""
+	if at := strings.LastIndex(root, "@"); at >= 0 && layoutName == bits[0] {
+		name = root[at+1:]
+		root = root[:at]
+		if slash := strings.Index(name, "/"); slash >= 0 {
+			subpath = name[slash+1:]
+			name = name[:slash]
+		}
+	} else if layoutName == "rsnapshot" && layoutName == bits[0] {
+		if base := path.Base(root); rsnapshotNameRe.MatchString(base) {
+			name = base
+			root = path.Dir(root)
+		}
+	}
+
+	if len(root) == 0 || len(name) == 0 {
+		return nil, true, errors.New("invalid snapshot specifier: " + spec + " (hint: zfs:/tank/home@latest)")
+	}
+
+	guess, err = layout(root, name)
+	if err != nil {
+		return nil, true, fmt.Errorf("%s: %s", spec, err)
+	}
+	guess.Layout = layoutName
+	guess.Directory = path.Join(guess.Directory, subpath)
+	guess.Root = path.Join(root, subpath)
+	return guess, true, nil
+}
+
+type snapshotCandidate struct {
+	name string
+	dir  string
+	time time.Time
+}
+
+func newestSnapshot(candidates []snapshotCandidate, root string) (*SnapshotGuess, error) {
+	if len(candidates) == 0 {
+		return nil, errors.New("no snapshots found in " + root)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].time.After(candidates[j].time)
+	})
+	c := candidates[0]
+	return &SnapshotGuess{
+		Name:      c.name,
+		Directory: c.dir,
+		Time:      c.time,
+	}, nil
+}
+
+func statSnapshotDir(dir string) (os.FileInfo, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, errors.New(dir + ": " + ERR_NOT_DIR.Error())
+	}
+	return st, nil
+}
+
+// rsnapshot keeps snapshots in ROOT/<interval>.<N> and touches each one
+// when it's created.
+func findRsnapshotSnapshot(root string, name string) (*SnapshotGuess, error) {
+	if name != "latest" {
+		dir := path.Join(root, name)
+		st, err := statSnapshotDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return &SnapshotGuess{Name: name, Directory: dir, Time: st.ModTime()}, nil
+	}
+
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []snapshotCandidate{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !rsnapshotNameRe.MatchString(entry.Name()) {
+			continue
+		}
+		candidates = append(candidates, snapshotCandidate{
+			name: entry.Name(),
+			dir:  path.Join(root, entry.Name()),
+			time: entry.ModTime(),
+		})
+	}
+	return newestSnapshot(candidates, root)
+}
+
+// snapper keeps snapshots in ROOT/.snapshots/<N>/snapshot, and records when
+// each was taken (in UTC) in ROOT/.snapshots/<N>/info.xml.
+func findSnapperSnapshot(root string, name string) (*SnapshotGuess, error) {
+	snapshotsDir := path.Join(root, ".snapshots")
+	if path.Base(root) == ".snapshots" {
+		snapshotsDir = root
+	}
+
+	snapperTime := func(num string) (time.Time, error) {
+		dir := path.Join(snapshotsDir, num, "snapshot")
+		st, err := statSnapshotDir(dir)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		info := struct {
+			Date string `xml:"date"`
+		}{}
+		data, err := ioutil.ReadFile(path.Join(snapshotsDir, num, "info.xml"))
+		if err == nil && xml.Unmarshal(data, &info) == nil {
+			t, err := time.ParseInLocation("2006-01-02 15:04:05", info.Date, time.UTC)
+			if err == nil {
+				return t, nil
+			}
+		}
+		return st.ModTime(), nil
+	}
+
+	if name != "latest" {
+		t, err := snapperTime(name)
+		if err != nil {
+			return nil, err
+		}
+		return &SnapshotGuess{
+			Name:      name,
+			Directory: path.Join(snapshotsDir, name, "snapshot"),
+			Time:      t,
+		}, nil
+	}
+
+	entries, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots are numbered in the order they're taken, so the highest
+	// number is the newest.
+	nums := []int{}
+	for _, entry := range entries {
+		num, err := strconv.Atoi(entry.Name())
+		if err == nil && entry.IsDir() {
+			nums = append(nums, num)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(nums)))
+
+	for _, num := range nums {
+		name := strconv.Itoa(num)
+		t, err := snapperTime(name)
+		if err != nil {
+			continue
+		}
+		return &SnapshotGuess{
+			Name:      name,
+			Directory: path.Join(snapshotsDir, name, "snapshot"),
+			Time:      t,
+		}, nil
+	}
+	return nil, errors.New("no snapshots found in " + snapshotsDir)
+}
+
+// zfsSnapshotTimeRe matches the timestamps which zfs-auto-snapshot, sanoid
+// and zrepl put in snapshot names, like zfs-auto-snap_daily-2026-10-17-0000,
+// autosnap_2026-10-17_00:00:01_daily and zrepl_20261017_000000_000, with an
+// optional time zone (like zrepl's rfc3339 format, 2026-10-17T00:00:00Z).
+var zfsSnapshotTimeRe = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})[-_T]?(\d{2}):?(\d{2})(?::?(\d{2}))?(?:[.,_]\d+)?(Z|[+-]\d{2}:?\d{2})?`)
+
+// zfsSnapshotTime returns the time in a snapshot's name, or the zero time if
+// it doesn't have one. zrepl names its snapshots in UTC; other times without
+// a time zone are local (zfs-auto-snapshot --utc names need TZ=UTC).
+func zfsSnapshotTime(name string) time.Time {
+	m := zfsSnapshotTimeRe.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}
+	}
+	if m[6] == "" {
+		m[6] = "00"
+	}
+	loc := time.Local
+	zone := strings.Replace(m[7], ":", "", 1)
+	if zone == "Z" || (zone == "" && strings.HasPrefix(name, "zrepl_")) {
+		loc = time.UTC
+	} else if zone != "" {
+		hours, _ := strconv.Atoi(zone[1:3])
+		minutes, _ := strconv.Atoi(zone[3:5])
+		offset := hours*3600 + minutes*60
+		if zone[0] == '-' {
+			offset = -offset
+		}
+		loc = time.FixedZone(zone, offset)
+	}
+	t, err := time.ParseInLocation(
+		"2006-01-02 15:04:05",
+		fmt.Sprintf("%s-%s-%s %s:%s:%s", m[1], m[2], m[3], m[4], m[5], m[6]),
+		loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// ZFS exposes snapshots in ROOT/.zfs/snapshot/<name>, but not when they were
+// taken (the times of a snapshot's directory are those of ROOT when the
+// snapshot was taken), so the time is read from the snapshot's name. It's
+// zero if the name doesn't have one, and "latest" only considers snapshots
+// whose names do.
+func findZFSSnapshot(root string, name string) (*SnapshotGuess, error) {
+	snapshotsDir := path.Join(root, ".zfs", "snapshot")
+
+	if name != "latest" {
+		dir := path.Join(snapshotsDir, name)
+		_, err := statSnapshotDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return &SnapshotGuess{Name: name, Directory: dir, Time: zfsSnapshotTime(name)}, nil
+	}
+
+	entries, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []snapshotCandidate{}
+	for _, entry := range entries {
+		t := zfsSnapshotTime(entry.Name())
+		if t.IsZero() {
+			logger.Debugf("%s: no time in the snapshot's name; ignoring", entry.Name())
+			continue
+		}
+		dir := path.Join(snapshotsDir, entry.Name())
+		_, err := statSnapshotDir(dir)
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, snapshotCandidate{
+			name: entry.Name(),
+			dir:  dir,
+			time: t,
+		})
+	}
+	if len(candidates) == 0 && len(entries) > 0 {
+		return nil, errors.New("no snapshots with a time in their name found in " + snapshotsDir + " (hint: name one with zfs:ROOT@NAME, and give the time it was taken with --as-of)")
+	}
+	return newestSnapshot(candidates, snapshotsDir)
+}
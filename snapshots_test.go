@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestZFSSnapshotTime(t *testing.T) {
+	// So local and UTC times differ wherever the test runs
+	defer func(orig *time.Location) { time.Local = orig }(time.Local)
+	time.Local = time.FixedZone("test", 5*3600)
+
+	local := func(hour, min, sec int) time.Time {
+		return time.Date(2026, 10, 17, hour, min, sec, 0, time.Local)
+	}
+	utc := func(hour, min, sec int) time.Time {
+		return time.Date(2026, 10, 17, hour, min, sec, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		expected time.Time
+	}{
+		// zfs-auto-snapshot and sanoid name snapshots in local time
+		{"zfs-auto-snap_daily-2026-10-17-0130", local(1, 30, 0)},
+		{"autosnap_2026-10-17_01:30:05_daily", local(1, 30, 5)},
+		{"manual-20261017-0130", local(1, 30, 0)},
+		// zrepl names them in UTC
+		{"zrepl_20261017_013005_000", utc(1, 30, 5)},
+		{"zrepl_2026-10-17T01:30:05Z", utc(1, 30, 5)},
+		// Explicit time zones are used
+		{"snap-2026-10-17T01:30:05Z", utc(1, 30, 5)},
+		{"snap-2026-10-17T03:30:05+02:00", utc(1, 30, 5)},
+		{"snap-2026-10-16T20:30:05.123-0500", utc(1, 30, 5)},
+		{"before-upgrade", time.Time{}},
+		{"snap-2026-13-17-0130", time.Time{}},
+	}
+	for _, test := range tests {
+		res := zfsSnapshotTime(test.name)
+		if !res.Equal(test.expected) {
+			t.Errorf("%s: got %s, expected %s", test.name, res, test.expected)
+		}
+	}
+}
+
+func TestFindZFSSnapshot(t *testing.T) {
+	root := t.TempDir()
+	snapshotsDir := path.Join(root, ".zfs", "snapshot")
+	for _, name := range []string{
+		"zrepl_20261017_013005_000",
+		"zrepl_20261016_013005_000",
+		"before-upgrade",
+	} {
+		err := os.MkdirAll(path.Join(snapshotsDir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	guess, err := findZFSSnapshot(root, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guess.Name != "zrepl_20261017_013005_000" || !guess.Time.Equal(time.Date(2026, 10, 17, 1, 30, 5, 0, time.UTC)) {
+		t.Errorf("got %s at %s, expected the newest zrepl snapshot", guess.Name, guess.Time)
+	}
+
+	// Snapshots without a time in their name need --as-of
+	guess, err = findZFSSnapshot(root, "before-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !guess.Time.IsZero() {
+		t.Errorf("got %s, expected no time for a snapshot without one in its name", guess.Time)
+	}
+}
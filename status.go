@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const LAST_RUN_FILE_NAME = "last-run"
+const LOCK_FILE_NAME = "lock"
+
+// PairResult is the outcome of checking one pair, which is saved to its
+// run-status directory so 'status' can show it.
+type PairResult struct {
+	Reference string `json:"reference,omitempty"`
+	Backup    string `json:"backup,omitempty"`
+	// The backup directory, or the root of its snapshots
+	BackupKey    string         `json:"backup_key,omitempty"`
+	Started      time.Time      `json:"started"`
+	Finished     time.Time      `json:"finished"`
+	Result       string         `json:"result"`
+	Checked      int            `json:"checked"`
+	Errors       int            `json:"errors"`
+	Diffs        map[string]int `json:"differences,omitempty"`
+	New          int            `json:"new"`
+	Resolved     int            `json:"resolved"`
+	Acknowledged int            `json:"acknowledged"`
+	Changed      int            `json:"changed"`
+	Filtered     int            `json:"filtered"`
+	Bytes        uint64         `json:"bytes"`
+	Pending      int            `json:"pending"`
+
+	// The last time the pair was completely checked without failing
+	LastSuccess time.Time `json:"last_success"`
+}
+
+func LoadPairResult(runStatusDir string) (*PairResult, error) {
+	data, err := ioutil.ReadFile(path.Join(runStatusDir, LAST_RUN_FILE_NAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	res := &PairResult{}
+	err = json.Unmarshal(data, res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *PairResult) Save(runStatusDir string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	resultPath := path.Join(runStatusDir, LAST_RUN_FILE_NAME)
+	tmpPath := resultPath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, append(data, '\n'), 0600)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, resultPath)
+}
+
+// runStatusName encodes a reference directory as the name of its run-status
+// directory: "/" becomes "-", and "-" becomes "--".
+func runStatusName(refRoot string) (string, error) {
+	refNorm, err := filepath.Abs(refRoot)
+	if err != nil {
+		return "", err
+	}
+	refNorm = filepath.Clean(refNorm)
+	refNorm = strings.Replace(refNorm, "-", "--", -1)
+	refNorm = strings.Replace(refNorm, "/", "-", -1)[1:]
+	return refNorm, nil
+}
+
+// decodeRunStatusName reverses runStatusName. It's ambiguous for paths with
+// a "-" next to a "/", so the reference saved in last-run is preferred.
+func decodeRunStatusName(name string) string {
+	res := []byte{'/'}
+	for idx := 0; idx < len(name); idx += 1 {
+		if name[idx] != '-' {
+			res = append(res, name[idx])
+		} else if idx+1 < len(name) && name[idx+1] == '-' {
+			res = append(res, '-')
+			idx += 1
+		} else {
+			res = append(res, '/')
+		}
+	}
+	return string(res)
+}
+
+// runStatusLockHolder returns the pid of the running process which holds
+// the lock on runStatusDir, or 0 if it isn't locked.
+func runStatusLockHolder(runStatusDir string) int {
+	data, err := ioutil.ReadFile(path.Join(runStatusDir, LOCK_FILE_NAME))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	err = syscall.Kill(pid, 0)
+	if err != nil && err != syscall.EPERM {
+		return 0
+	}
+	return pid
+}
+
+// lockRunStatusDir stops other processes from using runStatusDir until the
+// returned function is first called. Locks left by processes which have
+// exited are replaced.
+func lockRunStatusDir(runStatusDir string) (func(), error) {
+	lockPath := path.Join(runStatusDir, LOCK_FILE_NAME)
+	for attempt := 0; attempt < 2; attempt += 1 {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			var once sync.Once
+			return func() { once.Do(func() { os.Remove(lockPath) }) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if pid := runStatusLockHolder(runStatusDir); pid != 0 {
+			return nil, fmt.Errorf("%s is in use by process %d", runStatusDir, pid)
+		}
+		logger.Infof("Removing stale lock file: %s", lockPath)
+		os.Remove(lockPath)
+	}
+	return nil, errors.New("could not lock " + runStatusDir)
+}
+
+// pendingItems returns the number of items saved in runStatusDir's
+// walk-stack, which will be checked by the next run.
+func pendingItems(runStatusDir string) (int, error) {
+	f, err := os.Open(path.Join(runStatusDir, "walk-stack"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), WALK_STACK_SEEDS) {
+			continue
+		}
+		if len(strings.TrimSpace(scanner.Text())) > 0 {
+			count += 1
+		}
+	}
+	return count, scanner.Err()
+}
+
+func showStatus(out io.Writer, stateDir string) error {
+	statusRoot := path.Join(stateDir, "run-status")
+	entries, err := ioutil.ReadDir(statusRoot)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		fmt.Fprintf(out, "No saved run state in %s\n", statusRoot)
+		return nil
+	}
+
+	for _, name := range names {
+		runStatusDir := path.Join(statusRoot, name)
+		result, err := LoadPairResult(runStatusDir)
+		if err != nil {
+			logger.Warningf("Error loading %s: %s", path.Join(runStatusDir, LAST_RUN_FILE_NAME), err)
+			result = nil
+		}
+
+		ref := decodeRunStatusName(name)
+		if result != nil {
+			ref = result.Reference
+		}
+		fmt.Fprintf(out, "%s:\n", ref)
+
+		if result == nil {
+			fmt.Fprintf(out, "  Last run: unknown\n")
+		} else {
+			fmt.Fprintf(out, "  Backup: %s\n", result.Backup)
+			fmt.Fprintf(out, "  Last run: %s (%s, took %v)\n",
+				result.Started.Local().Format("2006-01-02 15:04:05"),
+				result.Result,
+				result.Finished.Sub(result.Started).Round(time.Second),
+			)
+			fmt.Fprintf(out, "  %s checked, %s errors, %s changed since backup, %s filtered, and %s bytes\n",
+				FormatInt(result.Checked),
+				FormatInt(result.Errors),
+				FormatInt(result.Changed),
+				FormatInt(result.Filtered),
+				FormatInt(int64(result.Bytes)),
+			)
+			if len(result.Diffs) > 0 {
+				fmt.Fprintf(out, "  Differences: %s (%s new)\n", describeCounts(result.Diffs, " "), FormatInt(result.New))
+			}
+			if result.Acknowledged > 0 {
+				fmt.Fprintf(out, "  Acknowledged: %s\n", FormatInt(result.Acknowledged))
+			}
+			if result.Resolved > 0 {
+				fmt.Fprintf(out, "  Resolved: %s\n", FormatInt(result.Resolved))
+			}
+			if !result.LastSuccess.IsZero() {
+				fmt.Fprintf(out, "  Last success: %s\n", result.LastSuccess.Local().Format("2006-01-02 15:04:05"))
+			}
+		}
+
+		pending, err := pendingItems(runStatusDir)
+		if err != nil {
+			fmt.Fprintf(out, "  Resume: unknown (%s)\n", err)
+		} else if pending > 0 {
+			fmt.Fprintf(out, "  Resume: %s items pending\n", FormatInt(pending))
+		} else {
+			fmt.Fprintf(out, "  Resume: nothing pending\n")
+		}
+
+		if pid := runStatusLockHolder(runStatusDir); pid != 0 {
+			fmt.Fprintf(out, "  Running: process %d\n", pid)
+		}
+
+		logPath := path.Join(runStatusDir, "log.txt")
+		if _, err := os.Stat(logPath); err == nil {
+			fmt.Fprintf(out, "  Log: %s\n", logPath)
+		}
+	}
+
+	return nil
+}
+
+// resetRunStatus discards the saved walk of target, which is a reference
+// directory, a REFERENCE_DIR:BACKUP_DIR pair, or a run-status directory name
+// as shown by 'status'.
+func resetRunStatus(out io.Writer, stateDir string, target string) error {
+	statusRoot := path.Join(stateDir, "run-status")
+	name := target
+	if _, err := os.Stat(path.Join(statusRoot, name)); name == "" || strings.Contains(name, "/") || err != nil {
+		ref := strings.SplitN(target, ":", 2)[0]
+		var err error
+		name, err = runStatusName(ref)
+		if err != nil {
+			return err
+		}
+	}
+
+	runStatusDir := path.Join(statusRoot, name)
+	if _, err := os.Stat(runStatusDir); err != nil {
+		return fmt.Errorf("no saved run state for %s (see 'status')", target)
+	}
+
+	unlock, err := lockRunStatusDir(runStatusDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pending, err := pendingItems(runStatusDir)
+	if err != nil {
+		return err
+	}
+	partialPaths, err := filepath.Glob(path.Join(runStatusDir, PARTIAL_DIFFERENCES_FILE_PREFIX+"*"))
+	if err != nil {
+		return err
+	}
+	for _, filePath := range append([]string{path.Join(runStatusDir, "walk-stack")}, partialPaths...) {
+		err = os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	ref := decodeRunStatusName(name)
+	if result, err := LoadPairResult(runStatusDir); err == nil && result != nil {
+		ref = result.Reference
+	}
+	fmt.Fprintf(out, "%s: discarded %s pending items; the next run will start from the beginning\n",
+		ref, FormatInt(pending))
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// SetRate sets the limit in units per second. A rate of 0 disables the
+// limit.
+func (l *RateLimiter) SetRate(rate float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = rate
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+func (l *RateLimiter) Rate() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n units can be used without going over the rate. At most
+// one second worth of unused capacity is saved up.
+func (l *RateLimiter) Wait(n int64) {
+	l.lock.Lock()
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type Throttle struct {
+	Bytes RateLimiter
+	Ops   RateLimiter
+
+	controlFile  string
+	controlMtime time.Time
+	lastReload   time.Time
+}
+
+var throttle = &Throttle{}
+
+func (t *Throttle) Open(path string) (*os.File, error) {
+	t.Ops.Wait(1)
+	return os.Open(path)
+}
+
+func (t *Throttle) Read(f *os.File, buf []byte) (int, error) {
+	t.MaybeReload()
+	t.Ops.Wait(1)
+	n, err := f.Read(buf)
+	t.Bytes.Wait(int64(n))
+	return n, err
+}
+
+func (t *Throttle) Describe() string {
+	bytes := t.Bytes.Rate()
+	ops := t.Ops.Rate()
+	if bytes <= 0 && ops <= 0 {
+		return ""
+	}
+
+	limits := []string{}
+	if bytes > 0 {
+		limits = append(limits, fmt.Sprintf("%0.01fMB/s", bytes/1024.0/1024.0))
+	}
+	if ops > 0 {
+		limits = append(limits, fmt.Sprintf("%0.0f ops/s", ops))
+	}
+	return "limit " + strings.Join(limits, ", ")
+}
+
+// WatchControlFile makes MaybeReload pick up limits from the named file, so
+// they can be adjusted while a run is in progress. The file contains lines
+// like "bwlimit 20M" or "ops-limit 100"; a limit of 0 disables it.
+func (t *Throttle) WatchControlFile(path string) {
+	t.controlFile = path
+}
+
+func (t *Throttle) MaybeReload() {
+	if t.controlFile == "" {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(t.lastReload).Seconds() < 2 {
+		return
+	}
+	t.lastReload = now
+
+	st, err := os.Stat(t.controlFile)
+	if err != nil || st.ModTime().Equal(t.controlMtime) {
+		return
+	}
+	t.controlMtime = st.ModTime()
+
+	err = t.loadControlFile()
+	if err != nil {
+		logger.Errorf("Error loading %s: %s", t.controlFile, err)
+		return
+	}
+	limits := t.Describe()
+	if limits == "" {
+		limits = "no limit"
+	}
+	logger.Infof("Reloaded I/O limits from %s: %s", t.controlFile, limits)
+}
+
+func (t *Throttle) loadControlFile() error {
+	f, err := os.Open(t.controlFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		bits := strings.Fields(line)
+		if len(bits) != 2 {
+			return fmt.Errorf("invalid line: %q (expected 'bwlimit 20M' or 'ops-limit 100')", line)
+		}
+
+		switch bits[0] {
+		case "bwlimit":
+			size, err := ParseByteSize(bits[1])
+			if err != nil {
+				return err
+			}
+			t.Bytes.SetRate(float64(size))
+		case "ops-limit":
+			ops, err := strconv.ParseFloat(bits[1], 64)
+			if err != nil {
+				return fmt.Errorf("invalid ops-limit: %s", bits[1])
+			}
+			t.Ops.SetRate(ops)
+		default:
+			return fmt.Errorf("unknown limit: %s", bits[0])
+		}
+	}
+
+	return scanner.Err()
+}
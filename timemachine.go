@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const TM_STD_EXCLUSIONS = "/System/Library/CoreServices/backupd.bundle/Contents/Resources/StdExclusions.plist"
+const TM_PREFERENCES = "/Library/Preferences/com.apple.TimeMachine.plist"
+
+func loadPlistDict(plistPath string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(plistPath)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := DecodePlist(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, ERR_PLIST_NOT_DICT
+	}
+	return dict, nil
+}
+
+func plistStrings(dict map[string]interface{}, keys ...string) []string {
+	res := []string{}
+	for _, key := range keys {
+		vals, _ := dict[key].([]interface{})
+		for _, val := range vals {
+			if s, ok := val.(string); ok && len(s) > 0 {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+// escapeIgnorePattern escapes the glob characters of a literal path, so it
+// can be used in an ignore rule.
+func escapeIgnorePattern(p string) string {
+	var res strings.Builder
+	for _, c := range p {
+		if strings.ContainsRune(`\*?[`, c) {
+			res.WriteRune('\\')
+		}
+		res.WriteRune(c)
+	}
+	return res.String()
+}
+
+// tmExcludePattern converts a path from a Time Machine plist to an ignore
+// rule relative to one of refRoots, which is anchored and matches whole path
+// segments. Paths starting with "~/" and relative paths are inside each
+// user's home directory, so they match at any depth. ok is false for
+// absolute paths outside every reference directory.
+func tmExcludePattern(p string, refRoots []string) (pattern string, ok bool) {
+	if strings.HasPrefix(p, "~/") {
+		p = p[2:]
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = strings.Trim(p, "/")
+		if p == "" {
+			return "", false
+		}
+		return "**/" + escapeIgnorePattern(p), true
+	}
+
+	for _, root := range refRoots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, filepath.Clean(p))
+		if err != nil || rel == "." || strings.HasPrefix(rel, "../") || rel == ".." {
+			continue
+		}
+		return "/" + escapeIgnorePattern(rel), true
+	}
+	return "", false
+}
+
+// loadTimeMachineExclusions reads Time Machine's standard exclusions
+// (StdExclusions.plist) and the user's exclusions (the Time Machine
+// preferences plist), and returns ignore rules relative to refRoots. Either
+// path may be "".
+func loadTimeMachineExclusions(stdExclusionsPath string, preferencesPath string, refRoots []string) ([]string, error) {
+	paths := []string{}
+	contents := []string{}
+
+	if stdExclusionsPath != "" {
+		std, err := loadPlistDict(stdExclusionsPath)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, plistStrings(std,
+			"PathsExcluded",
+			"PathsExcludedByStdExclusions",
+			"UserPathsExcluded",
+			"FileContentsExcluded",
+		)...)
+		contents = append(contents, plistStrings(std,
+			"ContentsExcluded",
+			"ContentsExcludedByStdExclusions",
+		)...)
+	}
+
+	if preferencesPath != "" {
+		prefs, err := loadPlistDict(preferencesPath)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, plistStrings(prefs,
+			"SkipPaths",
+			"ExcludeByPath",
+		)...)
+	}
+
+	res := []string{}
+	for _, p := range paths {
+		if pattern, ok := tmExcludePattern(p, refRoots); ok {
+			res = append(res, pattern)
+		}
+	}
+
+	// The directory itself is backed up, but not the things inside it.
+	for _, p := range contents {
+		if pattern, ok := tmExcludePattern(strings.TrimSuffix(p, "/"), refRoots); ok {
+			res = append(res, pattern+"/**")
+		}
+	}
+
+	return res, nil
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"os/user"
 	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -59,6 +61,110 @@ func FormatInt(n interface{}) string {
 	}
 }
 
+var timestampFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02-150405",
+	"2006-01-02",
+}
+
+// ParseTimestamp parses an absolute time. Times without a time zone are in
+// local time.
+func ParseTimestamp(s string) (time.Time, error) {
+	for _, format := range timestampFormats {
+		t, err := time.ParseInLocation(format, strings.TrimSpace(s), time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid time: " + s + " (ex, '2017-02-20 15:37' or '2017-02-20T15:37:25-05:00')")
+}
+
+type Age time.Duration
+
+var ageUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+	"y": 365 * 24 * time.Hour,
+}
+
+// ParseAge parses durations like "7d", "2w", "1y", or anything
+// time.ParseDuration accepts.
+func ParseAge(s string) (Age, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 1 {
+		if unit, ok := ageUnits[s[len(s)-1:]]; ok {
+			n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+			if err == nil && n >= 0 {
+				return Age(n * float64(unit)), nil
+			}
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid age: " + s + " (ex, '12h', '7d', '1y')")
+	}
+	return Age(d), nil
+}
+
+func (a *Age) UnmarshalFlag(value string) error {
+	age, err := ParseAge(value)
+	if err != nil {
+		return err
+	}
+	*a = age
+	return nil
+}
+
+type ByteSize int64
+
+var byteSizeSuffixes = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+	"P": 1 << 50,
+}
+
+// ParseByteSize parses sizes like "4096", "50M", "1.5G" or "500GiB". Suffixes
+// are powers of 1024.
+func ParseByteSize(s string) (ByteSize, error) {
+	num := strings.TrimSpace(s)
+	num = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(num), "B"), "I")
+	suffix := ""
+	if len(num) > 0 {
+		last := num[len(num)-1:]
+		if _, ok := byteSizeSuffixes[last]; ok {
+			suffix = last
+			num = num[:len(num)-1]
+		}
+	}
+
+	val, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || val < 0 {
+		return 0, errors.New("invalid size: " + s + " (ex, '4096', '50M', '500G')")
+	}
+
+	return ByteSize(val * float64(byteSizeSuffixes[suffix])), nil
+}
+
+func (s *ByteSize) UnmarshalFlag(value string) error {
+	size, err := ParseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
 func GetWinSize() (int, int, error) {
 	var ttyFd uintptr
 	tty, err := os.Open("/dev/tty")
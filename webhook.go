@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// WEBHOOK_RETRY_DELAY is how long to wait before the first retry of a
+// webhook. It doubles after each retry.
+var WEBHOOK_RETRY_DELAY = time.Second
+
+// Webhook statuses, which are also the healthchecks.io-style suffixes of the
+// URL they're sent to ("success" is sent to the URL itself).
+const (
+	WEBHOOK_START   = "start"
+	WEBHOOK_SUCCESS = "success"
+	WEBHOOK_FAIL    = "fail"
+)
+
+type webhookPayload struct {
+	Status     string        `json:"status"`
+	Host       string        `json:"host"`
+	Time       time.Time     `json:"time"`
+	Pairs      []string      `json:"pairs"`
+	ExitStatus int           `json:"exit_status"`
+	Summary    *PairResult   `json:"summary,omitempty"`
+	Results    []*PairResult `json:"results,omitempty"`
+}
+
+// Webhook sends a JSON payload to a URL when a run starts, succeeds and
+// fails, like healthchecks.io pings: URL/start, URL and URL/fail. A run
+// which ends without a run-end event (ex, a fatal error) is a failure.
+type Webhook struct {
+	url      string
+	template *template.Template
+	retries  int
+	client   *http.Client
+
+	payload webhookPayload
+	started bool
+	ended   bool
+}
+
+func NewWebhook(rawURL string, templatePath string, caPath string, retries int) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid --webhook URL: %s", rawURL)
+	}
+
+	w := &Webhook{
+		url:     strings.TrimRight(rawURL, "/"),
+		retries: retries,
+	}
+
+	if templatePath != "" {
+		data, err := ioutil.ReadFile(templatePath)
+		if err != nil {
+			return nil, err
+		}
+		w.template, err = template.New(templatePath).Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				res, err := json.Marshal(v)
+				return string(res), err
+			},
+		}).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --webhook-template: %s", err)
+		}
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if caPath != "" {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in --webhook-ca: %s", caPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	w.client = &http.Client{Transport: transport, Timeout: 30 * time.Second}
+
+	w.payload.Host, err = os.Hostname()
+	if err != nil {
+		w.payload.Host = "unknown"
+	}
+
+	return w, nil
+}
+
+func (w *Webhook) Report(e *Event) {
+	switch e.Event {
+	case EVENT_RUN_START:
+		w.started = true
+		w.payload.Pairs = e.Pairs
+		w.send(WEBHOOK_START, e.Time)
+	case EVENT_PAIR_END:
+		if e.Summary != nil {
+			w.payload.Results = append(w.payload.Results, e.Summary)
+		}
+	case EVENT_RUN_END:
+		w.ended = true
+		w.payload.Summary = e.Summary
+		status := WEBHOOK_SUCCESS
+		if e.ExitStatus != nil {
+			w.payload.ExitStatus = *e.ExitStatus
+			if *e.ExitStatus != 0 {
+				status = WEBHOOK_FAIL
+			}
+		}
+		w.send(status, e.Time)
+	}
+}
+
+// Close sends a failure if the run started but didn't end.
+func (w *Webhook) Close() error {
+	if w.started && !w.ended {
+		w.payload.ExitStatus = 1
+		w.send(WEBHOOK_FAIL, time.Now())
+	}
+	return nil
+}
+
+func (w *Webhook) body() ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(&w.payload)
+	}
+	buf := &bytes.Buffer{}
+	err := w.template.Execute(buf, &w.payload)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("--webhook-template didn't produce valid JSON: %s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// send posts the payload, retrying with exponential backoff on network
+// errors and 5xx or 429 responses.
+func (w *Webhook) send(status string, now time.Time) {
+	w.payload.Status = status
+	w.payload.Time = now
+	target := w.url
+	if status != WEBHOOK_SUCCESS {
+		target += "/" + status
+	}
+
+	body, err := w.body()
+	if err != nil {
+		logger.Errorf("Error sending webhook to %s: %s", target, err)
+		return
+	}
+
+	delay := WEBHOOK_RETRY_DELAY
+	for attempt := 0; ; attempt += 1 {
+		retry, err := w.post(target, body)
+		if err == nil {
+			logger.Debugf("Sent webhook: %s", target)
+			return
+		}
+		if !retry || attempt >= w.retries {
+			logger.Errorf("Error sending webhook to %s: %s", target, err)
+			return
+		}
+		logger.Warningf("Error sending webhook to %s (retrying in %s): %s", target, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (w *Webhook) post(target string, body []byte) (bool, error) {
+	res, err := w.client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		text, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		retry := res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(text)))
+	}
+	return false, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexcesaro/log"
+	"github.com/alexcesaro/log/golog"
+)
+
+func init() {
+	// _main sets up the logger, which tests don't run
+	logger = golog.New(ioutil.Discard, log.Debug)
+	WEBHOOK_RETRY_DELAY = time.Millisecond
+}
+
+type webhookRequest struct {
+	path string
+	body []byte
+}
+
+// webhookServer records the requests it gets, and responds to the Nth with
+// statuses[N] (or 200 once they run out).
+type webhookServer struct {
+	*httptest.Server
+	statuses []int
+
+	lock     sync.Mutex
+	requests []webhookRequest
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.lock.Lock()
+		idx := len(s.requests)
+		s.requests = append(s.requests, webhookRequest{r.URL.Path, body})
+		s.lock.Unlock()
+		if idx < len(s.statuses) {
+			http.Error(w, "nope", s.statuses[idx])
+		}
+	}))
+	return s
+}
+
+func (s *webhookServer) paths() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := []string{}
+	for _, req := range s.requests {
+		res = append(res, req.path)
+	}
+	return res
+}
+
+func (s *webhookServer) payload(t *testing.T, idx int) *webhookPayload {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := &webhookPayload{}
+	err := json.Unmarshal(s.requests[idx].body, res)
+	if err != nil {
+		t.Fatalf("request %d: %s: %s", idx, err, s.requests[idx].body)
+	}
+	return res
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func runWebhook(w *Webhook, exitStatus int) {
+	w.Report(&Event{Event: EVENT_RUN_START, Time: time.Now(), Pairs: []string{"/a:/b"}})
+	w.Report(&Event{Event: EVENT_PAIR_END, Summary: &PairResult{Reference: "/a", Checked: 3}})
+	w.Report(&Event{Event: EVENT_RUN_END, Time: time.Now(), ExitStatus: intPtr(exitStatus), Summary: &PairResult{Checked: 3}})
+	w.Close()
+}
+
+func checkPaths(t *testing.T, got []string, expected ...string) {
+	if strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("got requests to %q, expected %q", got, expected)
+	}
+}
+
+func TestWebhookSuccess(t *testing.T) {
+	s := newWebhookServer()
+	defer s.Close()
+	w, err := NewWebhook(s.URL+"/ping/", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runWebhook(w, 0)
+
+	checkPaths(t, s.paths(), "/ping/start", "/ping")
+	start := s.payload(t, 0)
+	if start.Status != WEBHOOK_START || len(start.Pairs) != 1 || start.Pairs[0] != "/a:/b" {
+		t.Errorf("unexpected start payload: %+v", start)
+	}
+	end := s.payload(t, 1)
+	if end.Status != WEBHOOK_SUCCESS || end.ExitStatus != 0 || end.Summary == nil || len(end.Results) != 1 {
+		t.Errorf("unexpected success payload: %+v", end)
+	}
+}
+
+func TestWebhookFail(t *testing.T) {
+	s := newWebhookServer()
+	defer s.Close()
+	w, err := NewWebhook(s.URL, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runWebhook(w, EXIT_DIFFERENCES)
+
+	checkPaths(t, s.paths(), "/start", "/fail")
+	end := s.payload(t, 1)
+	if end.Status != WEBHOOK_FAIL || end.ExitStatus != EXIT_DIFFERENCES {
+		t.Errorf("unexpected fail payload: %+v", end)
+	}
+}
+
+func TestWebhookCloseWithoutRunEnd(t *testing.T) {
+	s := newWebhookServer()
+	defer s.Close()
+	w, err := NewWebhook(s.URL, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Report(&Event{Event: EVENT_RUN_START, Time: time.Now()})
+	w.Close()
+
+	checkPaths(t, s.paths(), "/start", "/fail")
+	end := s.payload(t, 1)
+	if end.Status != WEBHOOK_FAIL || end.ExitStatus != 1 {
+		t.Errorf("unexpected fail payload: %+v", end)
+	}
+
+	// Nothing is sent for runs which never started
+	s2 := newWebhookServer()
+	defer s2.Close()
+	w, err = NewWebhook(s2.URL, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	checkPaths(t, s2.paths())
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		requests int
+	}{
+		{"retries on 500", []int{500, 503}, 3, 3},
+		{"retries on 429", []int{429}, 3, 2},
+		{"gives up after the retries", []int{500, 500, 500, 500}, 2, 3},
+		{"doesn't retry 4xx", []int{400}, 3, 1},
+		{"doesn't retry 404", []int{404}, 3, 1},
+	}
+	for _, test := range tests {
+		s := newWebhookServer(test.statuses...)
+		w, err := NewWebhook(s.URL, "", "", test.retries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.send(WEBHOOK_START, time.Now())
+		if got := len(s.paths()); got != test.requests {
+			t.Errorf("%s: got %d requests, expected %d", test.name, got, test.requests)
+		}
+		s.Close()
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	dir := t.TempDir()
+	writeTemplate := func(text string) string {
+		p := path.Join(dir, "template.json")
+		err := ioutil.WriteFile(p, []byte(text), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	_, err := NewWebhook("ftp://example.com", "", "", 0)
+	if err == nil {
+		t.Errorf("expected an error for a URL which isn't http or https")
+	}
+	_, err = NewWebhook("http://example.com", path.Join(dir, "missing.json"), "", 0)
+	if err == nil {
+		t.Errorf("expected an error for a missing --webhook-template")
+	}
+	_, err = NewWebhook("http://example.com", writeTemplate(`{"text": {{.Status}`), "", 0)
+	if err == nil || !strings.Contains(err.Error(), "invalid --webhook-template") {
+		t.Errorf("got %v, expected an invalid --webhook-template error", err)
+	}
+
+	// Templates which don't produce JSON aren't sent
+	s := newWebhookServer()
+	defer s.Close()
+	w, err := NewWebhook(s.URL, writeTemplate(`status: {{.Status}}`), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.send(WEBHOOK_START, time.Now())
+	checkPaths(t, s.paths())
+
+	w, err = NewWebhook(s.URL, writeTemplate(`{"text": {{json .Status}}, "host": {{json .Host}}}`), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.send(WEBHOOK_START, time.Now())
+	checkPaths(t, s.paths(), "/start")
+	body := map[string]string{}
+	err = json.Unmarshal(s.requests[0].body, &body)
+	if err != nil || body["text"] != WEBHOOK_START || body["host"] == "" {
+		t.Errorf("unexpected body: %s (%v)", s.requests[0].body, err)
+	}
+}